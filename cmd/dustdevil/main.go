@@ -9,6 +9,7 @@
 package main // import "github.com/solnx/dustdevil/cmd/dustdevil"
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -65,6 +66,11 @@ func main() {
 	if err := conf.FromFile(cliConfPath); err != nil {
 		logrus.Fatalf("Could not open configuration: %s", err)
 	}
+	settings := dustdevil.Settings{}
+	if err := settings.FromFile(cliConfPath); err != nil {
+		logrus.Fatalf("Could not open configuration: %s", err)
+	}
+	dustdevil.Configure(&settings)
 
 	// setup logfile
 	if lfh, err := reopen.NewFileWriter(
@@ -75,6 +81,9 @@ func main() {
 		conf.Log.FH = lfh
 	}
 	logrus.SetOutput(conf.Log.FH)
+	if settings.DustDevil.LogFormat == `json` {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
 	logrus.Infoln(`Starting DUSTDEVIL...`)
 
 	// signal handler will reopen logfile on USR2 if requested
@@ -90,11 +99,6 @@ func main() {
 
 	// this channel is used by the handlers on error
 	handlerDeath := make(chan error)
-	// this channel is used to signal the consumer to stop
-	consumerShutdown := make(chan struct{})
-	// this channel will be closed by the consumer
-	consumerExit := make(chan struct{})
-
 	// setup goroutine waiting policy
 	waitdelay := delay.New()
 
@@ -123,20 +127,88 @@ func main() {
 		})
 	}
 
+	// optional OpenTelemetry tracing
+	shutdownTracing, err := dustdevil.NewTracing(&settings)
+	if err != nil {
+		logrus.Fatalf("Unable to set up tracing: %s", err)
+	}
+
+	// shared liveness and readiness state
+	health := dustdevil.NewHealth(&settings, runtime.NumCPU())
+	dustdevil.ConfigureHealth(health)
+
+	// shared per-host delivery statistics
+	hostStats := dustdevil.NewHostStats(&settings)
+
+	// kafka consumer, paused and resumed via the admin API
+	consumer := dustdevil.NewConsumer(&conf, handlerDeath, health)
+
+	// optional HTTP listener for Prometheus and health checks
+	var httpErrors chan error
+	var httpServer *dustdevil.HTTPServer
+	if settings.DustDevil.HTTPListen != `` {
+		httpServer = dustdevil.NewHTTPServer(
+			settings.DustDevil.HTTPListen)
+		httpServer.Handle(`/metrics`, dustdevil.NewPrometheus(
+			pfxRegistry, metricPrefix, conf.Misc.InstanceName))
+		httpServer.Handle(`/healthz`, health.LiveHandler())
+		httpServer.Handle(`/readyz`, health.ReadyHandler())
+		if settings.DustDevil.AdminToken != `` {
+			httpServer.Handle(`/admin/`, dustdevil.NewAdmin(
+				settings.DustDevil.AdminToken, hostStats, consumer))
+		}
+		httpErrors = httpServer.Errors
+		logrus.Infof("Launched HTTP listener on %s",
+			settings.DustDevil.HTTPListen)
+		waitdelay.Go(func() {
+			httpServer.Run()
+		})
+	}
+
 	// acquire shared concurrency limit
 	lim := limit.New(conf.DustDevil.ConcurrencyLimit)
 
+	// setup shared endpoint pool
+	pool := dustdevil.NewPool(&conf, &settings)
+
+	// setup shared dead-letter file
+	deadLetter, err := dustdevil.NewDeadLetter(&settings)
+	if err != nil {
+		logrus.Fatalf("Unable to open dead-letter file: %s", err)
+	}
+	if deadLetter != nil && conf.Log.Rotate {
+		sigChanDeadLetter := make(chan os.Signal, 1)
+		signal.Notify(sigChanDeadLetter, syscall.SIGUSR2)
+		go func() {
+			for range sigChanDeadLetter {
+				if err := deadLetter.Reopen(); err != nil {
+					logrus.Errorf("Unable to reopen dead-letter"+
+						" file: %s", err)
+				}
+			}
+		}()
+	}
+
+	// setup shared rate limits
+	throttle := dustdevil.NewThrottle(&settings)
+
 	// start application handlers
 	for i := 0; i < runtime.NumCPU(); i++ {
 		h := dustdevil.DustDevil{
 			Num: i,
 			Input: make(chan *erebos.Transport,
 				conf.DustDevil.HandlerQueueLength),
-			Shutdown: make(chan struct{}),
-			Death:    handlerDeath,
-			Config:   &conf,
-			Metrics:  &pfxRegistry,
-			Limit:    lim,
+			Shutdown:   make(chan struct{}),
+			Death:      handlerDeath,
+			Config:     &conf,
+			Settings:   &settings,
+			Metrics:    &pfxRegistry,
+			Limit:      lim,
+			Pool:       pool,
+			DeadLetter: deadLetter,
+			Throttle:   throttle,
+			Health:     health,
+			Stats:      hostStats,
 		}
 		dustdevil.Handlers[i] = &h
 		waitdelay.Go(func() {
@@ -146,15 +218,17 @@ func main() {
 	}
 
 	// start kafka consumer
-	waitdelay.Go(func() {
-		erebos.Consumer(
-			&conf,
-			dustdevil.Dispatch,
-			consumerShutdown,
-			consumerExit,
-			handlerDeath,
-		)
-	})
+	consumer.Start()
+
+	// optional watchdog for stalled handlers
+	var stalled chan int
+	watchdog := dustdevil.NewWatchdog(&settings, health, pfxRegistry)
+	if watchdog != nil {
+		stalled = watchdog.Stalled
+		waitdelay.Go(func() {
+			watchdog.Run()
+		})
+	}
 
 	heartbeat := time.Tick(10 * time.Second)
 
@@ -165,14 +239,35 @@ runloop:
 		select {
 		case err := <-ms.Errors:
 			logrus.Errorf("Socket error: %s", err.Error())
+		case err := <-httpErrors:
+			logrus.Errorf("HTTP listener error: %s", err.Error())
 		case <-c:
 			logrus.Infoln(`Received shutdown signal`)
 			break runloop
 		case err := <-handlerDeath:
-			logrus.Errorf("Handler died: %s", err.Error())
+			logrus.WithFields(dustdevil.ErrorFields(err)).Errorf(
+				"Handler died: %s", err.Error())
+			fault = true
+			break runloop
+		case num := <-stalled:
+			logrus.Errorf("Handler %d stalled, shutting down for"+
+				" restart", num)
+			// the stalled handler may block the shutdown forever
+			time.AfterFunc(time.Duration(
+				settings.DustDevil.WatchdogShutdown)*time.Second,
+				func() {
+					logrus.Errorln(`Shutdown after stalled handler` +
+						` timed out, exiting`)
+					os.Exit(1)
+				})
 			fault = true
 			break runloop
 		case <-heartbeat:
+			health.Tick()
+			if settings.DustDevil.HostStatsTop > 0 {
+				hostStats.Publish(pfxRegistry,
+					settings.DustDevil.HostStatsTop)
+			}
 			for i := range dustdevil.Handlers {
 				// do not block on heartbeats
 				waitdelay.Go(func() {
@@ -185,10 +280,14 @@ runloop:
 
 	// close all handlers
 	close(ms.Shutdown)
-	close(consumerShutdown)
-
+	if watchdog != nil {
+		close(watchdog.Shutdown)
+	}
+	if httpServer != nil {
+		close(httpServer.Shutdown)
+	}
 	// not safe to close InputChannel before consumer is gone
-	<-consumerExit
+	consumer.Stop()
 	for i := range dustdevil.Handlers {
 		close(dustdevil.Handlers[i].ShutdownChannel())
 		close(dustdevil.Handlers[i].InputChannel())
@@ -201,7 +300,8 @@ drainloop:
 		case err := <-ms.Errors:
 			logrus.Errorf("Socket error: %s", err.Error())
 		case err := <-handlerDeath:
-			logrus.Errorf("Handler died: %s", err.Error())
+			logrus.WithFields(dustdevil.ErrorFields(err)).Errorf(
+				"Handler died: %s", err.Error())
 		case <-time.After(time.Millisecond * 10):
 			break drainloop
 		}
@@ -210,6 +310,9 @@ drainloop:
 	// give goroutines that were blocked on handlerDeath channel
 	// a chance to exit
 	waitdelay.Wait()
+	if err := shutdownTracing(context.Background()); err != nil {
+		logrus.Errorf("Tracing shutdown: %s", err)
+	}
 	logrus.Infoln(`DUSTDEVIL shutdown complete`)
 	if fault {
 		os.Exit(1)
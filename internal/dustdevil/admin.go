@@ -0,0 +1,274 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/solnx/legacy"
+)
+
+// Admin is the authenticated HTTP API for runtime inspection and
+// control, implementing http.Handler
+type Admin struct {
+	token    string
+	mux      *http.ServeMux
+	stats    *HostStats
+	consumer *Consumer
+	// audit logs all admin actions
+	audit *logrus.Logger
+}
+
+// handlerInfo is the state of a handler returned by the admin API
+type handlerInfo struct {
+	Num           int   `json:"num"`
+	QueueDepth    int   `json:"queue.depth"`
+	QueueCapacity int   `json:"queue.capacity"`
+	Inflight      int64 `json:"inflight"`
+}
+
+// NewAdmin returns the admin API. Requests must carry token as
+// bearer token.
+func NewAdmin(token string, stats *HostStats, consumer *Consumer) *Admin {
+	a := &Admin{
+		token:    token,
+		mux:      http.NewServeMux(),
+		stats:    stats,
+		consumer: consumer,
+		audit:    newAuditLog(),
+	}
+	a.mux.HandleFunc(`/admin/handlers`, a.handlers)
+	a.mux.HandleFunc(`/admin/assembly`, a.assembly)
+	a.mux.HandleFunc(`/admin/release`, a.release)
+	a.mux.HandleFunc(`/admin/pause`, a.pause)
+	a.mux.HandleFunc(`/admin/resume`, a.resume)
+	a.mux.HandleFunc(`/admin/loglevel`, a.loglevel)
+	a.mux.HandleFunc(`/admin/hosts`, a.hosts)
+	return a
+}
+
+// ServeHTTP authenticates and logs the request before serving it
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get(`Authorization`)
+	if !strings.HasPrefix(auth, `Bearer `) ||
+		subtle.ConstantTimeCompare([]byte(auth[len(`Bearer `):]),
+			[]byte(a.token)) != 1 {
+		a.audit.Warnf("Admin: rejected unauthenticated %s %s"+
+			" from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		http.Error(w, `unauthorized`, http.StatusUnauthorized)
+		return
+	}
+	a.audit.Infof("Admin: %s %s from %s", r.Method,
+		r.URL.RequestURI(), r.RemoteAddr)
+	a.mux.ServeHTTP(w, r)
+}
+
+// handlers lists all handlers with their queue depth and in-flight
+// requests
+func (a *Admin) handlers(w http.ResponseWriter, r *http.Request) {
+	info := []handlerInfo{}
+	for _, d := range selectHandlers(``) {
+		info = append(info, handlerInfo{
+			Num:           d.Num,
+			QueueDepth:    len(d.Input),
+			QueueCapacity: cap(d.Input),
+			Inflight:      atomic.LoadInt64(&d.inflight),
+		})
+	}
+	writeJSON(w, info)
+}
+
+// assembly dumps the split assembly per host of the selected
+// handlers
+func (a *Admin) assembly(w http.ResponseWriter, r *http.Request) {
+	dump := map[string]map[int][]legacy.MetricData{}
+	for _, d := range selectHandlers(r.URL.Query().Get(`handler`)) {
+		hosts := map[int][]legacy.MetricData{}
+		d.assemblyLock.Lock()
+		for hostID := range d.assembly {
+			for ts := range d.assembly[hostID] {
+				hosts[hostID] = append(hosts[hostID],
+					d.assembly[hostID][ts])
+			}
+		}
+		d.assemblyLock.Unlock()
+		dump[strconv.Itoa(d.Num)] = hosts
+	}
+	writeJSON(w, dump)
+}
+
+// release forces the release of assembled or aggregated metrics on
+// the selected handlers
+func (a *Admin) release(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	for _, d := range selectHandlers(r.URL.Query().Get(`handler`)) {
+		d := d
+		if err := d.control(func() {
+			switch {
+			case d.Config.DustDevil.InputFormat == `split`:
+				d.assemblyLock.Lock()
+				d.release()
+				d.assemblyLock.Unlock()
+			case d.Settings.DustDevil.Aggregate:
+				d.flushAggregation()
+			}
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		a.audit.Infof("Admin: released handler %d", d.Num)
+	}
+	writeJSON(w, `ok`)
+}
+
+// pause stops the consumer, messages that were already dispatched
+// are still processed
+func (a *Admin) pause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+		return
+	}
+	a.consumer.Pause()
+	a.audit.Infoln(`Admin: paused consumption`)
+	writeJSON(w, `paused`)
+}
+
+// resume starts consuming messages again
+func (a *Admin) resume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+		return
+	}
+	a.consumer.Resume()
+	a.audit.Infoln(`Admin: resumed consumption`)
+	writeJSON(w, `resumed`)
+}
+
+// loglevel returns or sets the log level
+func (a *Admin) loglevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		level, err := logrus.ParseLevel(r.URL.Query().Get(`level`))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logrus.SetLevel(level)
+		a.audit.Infof("Admin: set log level to %s", level)
+	}
+	writeJSON(w, logrus.GetLevel().String())
+}
+
+// hosts returns the delivery statistics of the host given by the
+// host parameter, of the top hosts by volume given by the top
+// parameter, or of all hosts
+func (a *Admin) hosts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get(`host`) != `` {
+		hostID, err := strconv.Atoi(query.Get(`host`))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stat, ok := a.stats.Lookup(hostID)
+		if !ok {
+			http.Error(w, `unknown host`, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, stat)
+		return
+	}
+
+	top := 0
+	if query.Get(`top`) != `` {
+		var err error
+		if top, err = strconv.Atoi(query.Get(`top`)); err != nil ||
+			top < 1 {
+			http.Error(w, `invalid top parameter`,
+				http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, a.stats.Top(top))
+}
+
+// selectHandlers returns the handler with number num, or all
+// handlers ordered by number if num is empty
+func selectHandlers(num string) []*DustDevil {
+	selected := []*DustDevil{}
+	for i := range Handlers {
+		d, ok := Handlers[i].(*DustDevil)
+		if !ok {
+			continue
+		}
+		if num != `` && strconv.Itoa(d.Num) != num {
+			continue
+		}
+		selected = append(selected, d)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Num < selected[j].Num
+	})
+	return selected
+}
+
+// newAuditLog returns a logger for admin actions that writes to the
+// logfile of the standard logger, independent of its log level
+func newAuditLog() *logrus.Logger {
+	std := logrus.StandardLogger()
+	return &logrus.Logger{
+		Out:       std.Out,
+		Formatter: std.Formatter,
+		Hooks:     std.Hooks,
+		Level:     logrus.InfoLevel,
+	}
+}
+
+// writeJSON writes v as JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set(`Content-Type`, `application/json`)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("Admin: %s", err)
+	}
+}
+
+// control runs fn in the event loop of the handler and waits for it
+// to finish
+func (d *DustDevil) control(fn func()) error {
+	done := make(chan struct{})
+	select {
+	case d.controlC <- func() {
+		fn()
+		close(done)
+	}:
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("Handler %d is not accepting requests",
+			d.Num)
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(time.Minute):
+		return fmt.Errorf("Handler %d did not finish in time", d.Num)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
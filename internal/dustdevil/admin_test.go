@@ -0,0 +1,46 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuthentication(t *testing.T) {
+	tests := []struct {
+		header string
+		status int
+	}{
+		{header: ``, status: http.StatusUnauthorized},
+		{header: `secret`, status: http.StatusUnauthorized},
+		{header: `Basic secret`, status: http.StatusUnauthorized},
+		{header: `Bearer secrets`, status: http.StatusUnauthorized},
+		{header: `Bearer `, status: http.StatusUnauthorized},
+		{header: `Bearer secret`, status: http.StatusOK},
+	}
+
+	a := NewAdmin(`secret`, NewHostStats(testSettings(t, ``)), nil)
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, `/admin/loglevel`,
+			nil)
+		if tc.header != `` {
+			req.Header.Set(`Authorization`, tc.header)
+		}
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("Authorization %q: status %d, expected %d",
+				tc.header, rec.Code, tc.status)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,136 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/legacy"
+)
+
+func TestAggregateFormatSetting(t *testing.T) {
+	tests := []struct {
+		format string
+		valid  bool
+	}{
+		{format: ``, valid: true},
+		{format: `array`, valid: true},
+		{format: `ndjson`, valid: true},
+		{format: `json`, valid: false},
+	}
+
+	for _, tc := range tests {
+		s := &Settings{}
+		err := s.fromJSON([]byte(`{"dustdevil":{"aggregate.format":"` +
+			tc.format + `"}}`))
+		if (err == nil) != tc.valid {
+			t.Errorf("aggregate.format %q: valid=%t, error: %v",
+				tc.format, tc.valid, err)
+		}
+	}
+}
+
+func TestCommitGroup(t *testing.T) {
+	d := newTestHandler(t, `batch`, false, ``, ``)
+	msgs := []*erebos.Transport{
+		testMessage(t, 1, 1, nil),
+		testMessage(t, 1, 2, nil),
+	}
+	g := &commitGroup{pending: 3, msgs: msgs}
+
+	for i, expected := range []int{0, 0, 2} {
+		d.commitDone(g)
+		d.delay.Wait()
+		if n := committed(msgs...); n != expected {
+			t.Errorf("After request %d: committed %d messages,"+
+				" expected %d", i+1, n, expected)
+		}
+	}
+}
+
+// TestReleaseAggregated checks that the assembled MetricSplit of all
+// hosts are sent in one aggregated request and only committed if it
+// succeeds
+func TestReleaseAggregated(t *testing.T) {
+	tests := []struct {
+		format string
+		status int
+		// separator of the host batches in the request body
+		sep []byte
+	}{
+		{format: `array`, status: http.StatusOK, sep: []byte(`},{`)},
+		{format: `ndjson`, status: http.StatusOK, sep: []byte("}\n{")},
+		{format: `array`, status: http.StatusBadRequest},
+	}
+
+	ts := time.Now().UTC().Truncate(time.Second)
+	for _, tc := range tests {
+		sink := newTestSink(t, tc.status)
+		d := newTestHandler(t, `split`, false, sink.URL,
+			`"aggregate.requests":"true",`+
+				`"aggregate.format":"`+tc.format+`"`)
+
+		msgs := []*erebos.Transport{}
+		for hostID := 1; hostID <= 2; hostID++ {
+			msg := testMessage(t, hostID, int64(hostID),
+				&legacy.MetricSplit{
+					HostID: hostID,
+					TS:     ts,
+					Path:   `/sys/load`,
+					Type:   `real`,
+					Val:    legacy.MetricValue{FlpVal: 1},
+				})
+			msgs = append(msgs, msg)
+			d.process(msg)
+		}
+		d.assemblyLock.Lock()
+		d.release()
+		d.assemblyLock.Unlock()
+		d.delay.Wait()
+
+		posts := sink.posts()
+		if len(posts) != 1 {
+			t.Fatalf("%s/%d: received %d POST requests, expected 1",
+				tc.format, tc.status, len(posts))
+		}
+		if tc.status != http.StatusOK {
+			select {
+			case <-d.Death:
+			default:
+				t.Errorf("%s/%d: failed request was not reported",
+					tc.format, tc.status)
+			}
+			if n := committed(msgs...); n != 0 {
+				t.Errorf("%s/%d: committed %d messages of a failed"+
+					" request", tc.format, tc.status, n)
+			}
+			continue
+		}
+
+		noDeath(t, d)
+		if bytes.Count(posts[0], tc.sep) != 1 {
+			t.Errorf("%s: body does not hold 2 batches: %s",
+				tc.format, posts[0])
+		}
+		if tc.format == `array` && !json.Valid(posts[0]) {
+			t.Errorf("%s: body is not JSON: %s", tc.format, posts[0])
+		}
+		if n := committed(msgs...); n != len(msgs) {
+			t.Errorf("%s: committed %d of %d messages", tc.format, n,
+				len(msgs))
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,102 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+var (
+	// magic bytes of the supported compression formats
+	magicGzip   = []byte{0x1f, 0x8b}
+	magicZstd   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicSnappy = []byte{0xff, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y'}
+	magicLZ4    = []byte{0x04, 0x22, 0x4d, 0x18}
+
+	// zstdDecoder is safe for concurrent use via DecodeAll
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// detectCodec returns the compression codec of value based on its
+// magic bytes
+func detectCodec(value []byte) string {
+	switch {
+	case bytes.HasPrefix(value, magicGzip):
+		return `gzip`
+	case bytes.HasPrefix(value, magicZstd):
+		return `zstd`
+	case bytes.HasPrefix(value, magicSnappy):
+		return `snappy`
+	case bytes.HasPrefix(value, magicLZ4):
+		return `lz4`
+	}
+	return `none`
+}
+
+// decompress returns the uncompressed form of value. If codec is
+// auto, the codec is detected via the magic bytes of value.
+func decompress(value []byte, codec string) ([]byte, error) {
+	if codec == `auto` {
+		codec = detectCodec(value)
+	}
+
+	switch codec {
+	case ``, `none`:
+		return value, nil
+	case `gzip`:
+		r, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case `zstd`:
+		return zstdDecoder.DecodeAll(value, nil)
+	case `snappy`:
+		return ioutil.ReadAll(snappy.NewReader(bytes.NewReader(value)))
+	case `lz4`:
+		return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(value)))
+	}
+	return nil, fmt.Errorf("Unknown compression codec: %s", codec)
+}
+
+// compress returns value compressed with codec, which is one of gzip
+// or zstd. A level of 0 selects the default compression level.
+func (d *DustDevil) compress(value []byte, codec string, level int) ([]byte, error) {
+	switch codec {
+	case `gzip`:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		buf := &bytes.Buffer{}
+		w, err := gzip.NewWriterLevel(buf, level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write(value); err != nil {
+			return nil, err
+		}
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case `zstd`:
+		return d.zstdEncoder.EncodeAll(value, nil), nil
+	}
+	return nil, fmt.Errorf("Unknown compression codec: %s", codec)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
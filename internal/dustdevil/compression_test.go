@@ -0,0 +1,229 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// testPayload is the uncompressed payload of the compression tests
+var testPayload = []byte(`{"host_id":42,"version":1,"data":[]}`)
+
+// compressWith returns value compressed by the writer that newWriter
+// wraps around a buffer
+func compressWith(t *testing.T, value []byte, newWriter func(io.Writer) io.WriteCloser) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := newWriter(buf)
+	if _, err := w.Write(value); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testCompressed returns testPayload compressed with every supported
+// codec
+func testCompressed(t *testing.T) map[string][]byte {
+	zstdWriter := func(w io.Writer) io.WriteCloser {
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zw
+	}
+	return map[string][]byte{
+		`none`: testPayload,
+		`gzip`: compressWith(t, testPayload,
+			func(w io.Writer) io.WriteCloser {
+				return gzip.NewWriter(w)
+			}),
+		`zstd`: compressWith(t, testPayload, zstdWriter),
+		`snappy`: compressWith(t, testPayload,
+			func(w io.Writer) io.WriteCloser {
+				return snappy.NewBufferedWriter(w)
+			}),
+		`lz4`: compressWith(t, testPayload,
+			func(w io.Writer) io.WriteCloser {
+				return lz4.NewWriter(w)
+			}),
+	}
+}
+
+func TestDetectCodec(t *testing.T) {
+	tests := []struct {
+		value []byte
+		codec string
+	}{
+		{value: []byte{0x1f, 0x8b, 0x08}, codec: `gzip`},
+		{value: []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, codec: `zstd`},
+		{value: []byte("\xff\x06\x00\x00sNaPpY"), codec: `snappy`},
+		{value: []byte{0x04, 0x22, 0x4d, 0x18, 0x64}, codec: `lz4`},
+		{value: testPayload, codec: `none`},
+		{value: []byte{0x1f}, codec: `none`},
+		{value: []byte{}, codec: `none`},
+	}
+
+	for _, tc := range tests {
+		if codec := detectCodec(tc.value); codec != tc.codec {
+			t.Errorf("detectCodec(%x) = %s, expected %s", tc.value,
+				codec, tc.codec)
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	for codec, value := range testCompressed(t) {
+		for _, setting := range []string{codec, `auto`} {
+			out, err := decompress(value, setting)
+			if err != nil {
+				t.Errorf("decompress %s as %s: %s", codec, setting,
+					err)
+				continue
+			}
+			if !bytes.Equal(out, testPayload) {
+				t.Errorf("decompress %s as %s = %q", codec, setting,
+					out)
+			}
+		}
+	}
+}
+
+func TestDecompressErrors(t *testing.T) {
+	tests := []struct {
+		value []byte
+		codec string
+	}{
+		{value: testPayload, codec: `gzip`},
+		{value: testPayload, codec: `zstd`},
+		{value: testPayload, codec: `brotli`},
+		// truncated gzip stream detected by its magic bytes
+		{value: []byte{0x1f, 0x8b, 0x08}, codec: `auto`},
+	}
+
+	for _, tc := range tests {
+		if _, err := decompress(tc.value, tc.codec); err == nil {
+			t.Errorf("decompress(%q, %s) did not fail", tc.value,
+				tc.codec)
+		}
+	}
+}
+
+func TestInputCompressionSetting(t *testing.T) {
+	tests := []struct {
+		options string
+		valid   bool
+	}{
+		{options: ``, valid: true},
+		{options: `"input.compression":"none"`, valid: true},
+		{options: `"input.compression":"gzip"`, valid: true},
+		{options: `"input.compression":"zstd"`, valid: true},
+		{options: `"input.compression":"snappy"`, valid: true},
+		{options: `"input.compression":"lz4"`, valid: true},
+		{options: `"input.compression":"brotli"`, valid: false},
+		{options: `"input.compression":"GZIP"`, valid: false},
+	}
+
+	for _, tc := range tests {
+		s := &Settings{}
+		err := s.fromJSON([]byte(`{"dustdevil":{` + tc.options + `}}`))
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: valid=%t, error: %v", tc.options, tc.valid,
+				err)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	tests := []struct {
+		codec string
+		level int
+	}{
+		{codec: `gzip`, level: 0},
+		{codec: `gzip`, level: 1},
+		{codec: `gzip`, level: 9},
+		{codec: `gzip`, level: -2},
+		{codec: `zstd`, level: 0},
+		{codec: `zstd`, level: 19},
+	}
+
+	for _, tc := range tests {
+		d := newTestHandler(t, `batch`, false, ``, fmt.Sprintf(
+			`"output.compression":%q,"output.compression.level":"%d"`,
+			tc.codec, tc.level))
+		value, err := d.compress(testPayload, tc.codec, tc.level)
+		if err != nil {
+			t.Errorf("%s level %d: %s", tc.codec, tc.level, err)
+			continue
+		}
+		if detectCodec(value) != tc.codec {
+			t.Errorf("%s level %d: detected as %s", tc.codec,
+				tc.level, detectCodec(value))
+		}
+		out, err := decompress(value, tc.codec)
+		if err != nil || !bytes.Equal(out, testPayload) {
+			t.Errorf("%s level %d: decompressed %q, %v", tc.codec,
+				tc.level, out, err)
+		}
+	}
+
+	d := newTestHandler(t, `batch`, false, ``, ``)
+	if _, err := d.compress(testPayload, `brotli`, 0); err == nil {
+		t.Error(`compress with unknown codec did not fail`)
+	}
+}
+
+func TestOutputCompressionSetting(t *testing.T) {
+	tests := []struct {
+		options string
+		valid   bool
+	}{
+		{options: ``, valid: true},
+		{options: `"output.compression":"gzip"`, valid: true},
+		{options: `"output.compression":"zstd"`, valid: true},
+		{options: `"output.compression":"brotli"`, valid: false},
+		{options: `"output.compression":"gzip",` +
+			`"output.compression.level":"-2"`, valid: true},
+		{options: `"output.compression":"gzip",` +
+			`"output.compression.level":"9"`, valid: true},
+		{options: `"output.compression":"gzip",` +
+			`"output.compression.level":"-3"`, valid: false},
+		{options: `"output.compression":"gzip",` +
+			`"output.compression.level":"10"`, valid: false},
+		{options: `"output.compression":"zstd",` +
+			`"output.compression.level":"0"`, valid: true},
+		{options: `"output.compression":"zstd",` +
+			`"output.compression.level":"22"`, valid: true},
+		{options: `"output.compression":"zstd",` +
+			`"output.compression.level":"23"`, valid: false},
+		{options: `"output.compression":"zstd",` +
+			`"output.compression.level":"-1"`, valid: false},
+	}
+
+	for _, tc := range tests {
+		s := &Settings{}
+		err := s.fromJSON([]byte(`{"dustdevil":{` + tc.options + `}}`))
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: valid=%t, error: %v", tc.options, tc.valid,
+				err)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,112 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"sync"
+
+	"github.com/mjolnir42/erebos"
+)
+
+// Consumer runs the erebos consumer. erebos can not pause the
+// partitions of a running consumer, pausing consumption stops the
+// consumer and resuming starts a new one. The consumer group
+// rebalances in between.
+type Consumer struct {
+	lock   sync.Mutex
+	health *Health
+	// run runs one consumer until shutdown is closed, it closes exit
+	run func(shutdown, exit chan struct{})
+	// channels of the running consumer, nil if it is not running
+	shutdown chan struct{}
+	exit     chan struct{}
+	paused   bool
+	stopped  bool
+}
+
+// NewConsumer returns a Consumer for conf that dispatches to the
+// handlers and sends errors to death
+func NewConsumer(conf *erebos.Config, death chan error, h *Health) *Consumer {
+	return &Consumer{
+		health: h,
+		run: func(shutdown, exit chan struct{}) {
+			erebos.Consumer(conf, Dispatch, shutdown, exit, death)
+		},
+	}
+}
+
+// Start starts consuming messages
+func (c *Consumer) Start() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.start()
+}
+
+// Pause stops the consumer until Resume is called. Messages that
+// were already dispatched are still processed.
+func (c *Consumer) Pause() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.paused = true
+	c.stop()
+}
+
+// Resume starts a new consumer after Pause
+func (c *Consumer) Resume() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.paused = false
+	c.start()
+}
+
+// Stop stops the consumer for the shutdown and waits for it to exit.
+// It is not restarted by Resume.
+func (c *Consumer) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stopped = true
+	c.stop()
+}
+
+// start runs a new consumer unless one is running, paused or
+// stopped. c.lock must be held.
+func (c *Consumer) start() {
+	if c.shutdown != nil || c.paused || c.stopped {
+		return
+	}
+	shutdown, exit := make(chan struct{}), make(chan struct{})
+	c.shutdown, c.exit = shutdown, exit
+	c.health.consumerStarted()
+
+	go func() {
+		c.run(shutdown, exit)
+
+		// the consumer returned on its own after an error
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.exit == exit {
+			c.shutdown, c.exit = nil, nil
+			c.health.consumerStopped()
+		}
+	}()
+}
+
+// stop stops the running consumer and waits for it to exit. c.lock
+// must be held.
+func (c *Consumer) stop() {
+	if c.shutdown == nil {
+		return
+	}
+	close(c.shutdown)
+	<-c.exit
+	c.shutdown, c.exit = nil, nil
+	c.health.consumerStopped()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,74 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConsumerPause checks that pausing stops the consumer instead
+// of blocking Dispatch, and that resuming starts a new one
+func TestConsumerPause(t *testing.T) {
+	h := NewHealth(testSettings(t, ``), 0)
+	started := make(chan struct{}, 4)
+	var running int64
+	c := &Consumer{
+		health: h,
+		run: func(shutdown, exit chan struct{}) {
+			atomic.AddInt64(&running, 1)
+			started <- struct{}{}
+			<-shutdown
+			atomic.AddInt64(&running, -1)
+			close(exit)
+		},
+	}
+
+	steps := []struct {
+		name  string
+		fn    func()
+		start bool
+		ready bool
+	}{
+		{`start`, c.Start, true, true},
+		{`pause`, c.Pause, false, false},
+		{`start while paused`, c.Start, false, false},
+		{`resume`, c.Resume, true, true},
+		{`stop`, c.Stop, false, false},
+		{`resume after stop`, c.Resume, false, false},
+	}
+	for _, step := range steps {
+		step.fn()
+		if step.start {
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: consumer was not started", step.name)
+			}
+		}
+		expected := int64(0)
+		if step.ready {
+			expected = 1
+		}
+		if n := atomic.LoadInt64(&running); n != expected {
+			t.Errorf("%s: %d consumers running, expected %d",
+				step.name, n, expected)
+		}
+		if r := len(h.Ready()) == 0; r != step.ready {
+			t.Errorf("%s: ready=%t, expected %t", step.name, r,
+				step.ready)
+		}
+	}
+	if len(started) != 0 {
+		t.Errorf("Started %d unexpected consumers", len(started))
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
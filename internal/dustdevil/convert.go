@@ -0,0 +1,112 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// StringConversion is a rule that converts string metrics into
+// integer metrics. The first rule whose path glob matches a string
+// metric is applied.
+type StringConversion struct {
+	// name of the rule, used in metrics
+	Name string `json:"name"`
+	// shell glob matched against the metric path
+	PathGlob string `json:"path.glob"`
+	// map of string values to their integer value
+	Values map[string]string `json:"values"`
+	// parse numeric strings that are not in Values
+	Parse bool `json:"parse,string"`
+	// integer value of strings that are neither in Values nor
+	// numeric, if empty they are handled as string metric
+	Default string `json:"default"`
+}
+
+// conversion is the compiled form of a StringConversion
+type conversion struct {
+	name     string
+	glob     string
+	values   map[string]int64
+	parse    bool
+	fallback *int64
+}
+
+// compileConversion returns the compiled form of c
+func compileConversion(c StringConversion) (*conversion, error) {
+	var err error
+
+	if c.Name == `` {
+		return nil, fmt.Errorf("StringConversion without name")
+	}
+	if c.PathGlob == `` {
+		return nil, fmt.Errorf("StringConversion %s has no path.glob",
+			c.Name)
+	}
+	if _, err = path.Match(c.PathGlob, ``); err != nil {
+		return nil, fmt.Errorf("StringConversion %s: %s", c.Name, err)
+	}
+
+	v := &conversion{
+		name:   c.Name,
+		glob:   c.PathGlob,
+		values: make(map[string]int64),
+		parse:  c.Parse,
+	}
+	for str, num := range c.Values {
+		if v.values[str], err = strconv.ParseInt(num, 10,
+			64); err != nil {
+			return nil, fmt.Errorf("StringConversion %s: %s",
+				c.Name, err)
+		}
+	}
+	if c.Default != `` {
+		var fallback int64
+		if fallback, err = strconv.ParseInt(c.Default, 10,
+			64); err != nil {
+			return nil, fmt.Errorf("StringConversion %s: %s",
+				c.Name, err)
+		}
+		v.fallback = &fallback
+	}
+	return v, nil
+}
+
+// convert returns the integer value of the string metric value
+func (c *conversion) convert(value string) (int64, bool) {
+	if num, ok := c.values[value]; ok {
+		return num, true
+	}
+	if c.parse {
+		if num, err := strconv.ParseInt(strings.TrimSpace(value), 10,
+			64); err == nil {
+			return num, true
+		}
+	}
+	if c.fallback != nil {
+		return *c.fallback, true
+	}
+	return 0, false
+}
+
+// conversion returns the conversion rule for the string metric
+// metricPath, or nil if no rule matches
+func (s *Settings) conversion(metricPath string) *conversion {
+	for _, c := range s.conversions {
+		if ok, _ := path.Match(c.glob, metricPath); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
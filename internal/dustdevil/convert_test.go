@@ -0,0 +1,159 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"testing"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+func TestCompileConversion(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  StringConversion
+		valid bool
+	}{
+		{`minimal`, StringConversion{Name: `a`, PathGlob: `/*`}, true},
+		{`all options`, StringConversion{Name: `a`, PathGlob: `/*`,
+			Values: map[string]string{`up`: `1`, `down`: `-1`},
+			Parse:  true, Default: `0`}, true},
+		{`without name`, StringConversion{PathGlob: `/*`}, false},
+		{`without glob`, StringConversion{Name: `a`}, false},
+		{`broken glob`, StringConversion{Name: `a`, PathGlob: `[`},
+			false},
+		{`non-numeric value`, StringConversion{Name: `a`,
+			PathGlob: `/*`, Values: map[string]string{`up`: `one`}},
+			false},
+		{`non-numeric default`, StringConversion{Name: `a`,
+			PathGlob: `/*`, Default: `none`}, false},
+	}
+
+	for _, tc := range tests {
+		if _, err := compileConversion(tc.rule); (err == nil) !=
+			tc.valid {
+			t.Errorf("%s: valid=%t, error: %v", tc.name, tc.valid, err)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	values := map[string]string{`up`: `1`, `down`: `0`, `42`: `-42`}
+
+	tests := []struct {
+		name   string
+		rule   StringConversion
+		value  string
+		result int64
+		ok     bool
+	}{
+		{`mapped`, StringConversion{Values: values}, `up`, 1, true},
+		{`mapped zero`, StringConversion{Values: values}, `down`, 0,
+			true},
+		{`unmapped`, StringConversion{Values: values}, `unknown`, 0,
+			false},
+		{`numeric without parse`, StringConversion{Values: values},
+			`7`, 0, false},
+		{`parse`, StringConversion{Parse: true}, ` 7 `, 7, true},
+		{`parse negative`, StringConversion{Parse: true}, `-7`, -7,
+			true},
+		{`mapping before parse`, StringConversion{Values: values,
+			Parse: true}, `42`, -42, true},
+		{`parse failure`, StringConversion{Parse: true}, `7.5`, 0,
+			false},
+		{`default`, StringConversion{Values: values, Parse: true,
+			Default: `-1`}, `unknown`, -1, true},
+	}
+
+	for _, tc := range tests {
+		tc.rule.Name = tc.name
+		tc.rule.PathGlob = `/*`
+		c, err := compileConversion(tc.rule)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		result, ok := c.convert(tc.value)
+		if ok != tc.ok || result != tc.result {
+			t.Errorf("%s: convert(%q) = %d, %t; expected %d, %t",
+				tc.name, tc.value, result, ok, tc.result, tc.ok)
+		}
+	}
+}
+
+// testConversions maps the state of services and parses versions,
+// the first matching rule is applied
+const testConversions = `"string.conversions":[
+	{"name":"state","path.glob":"/service/*/state",
+	 "values":{"running":"1","stopped":"0"}},
+	{"name":"service","path.glob":"/service/*/*","parse":"true"}
+]`
+
+func TestConvertBatchAndSplit(t *testing.T) {
+	d := newTestHandler(t, `batch`, false, ``, testConversions)
+
+	batch := &legacy.MetricBatch{
+		Data: []legacy.MetricData{{
+			StringMetrics: []legacy.StringMetric{
+				{Metric: `/service/web/state`, Value: `running`},
+				{Metric: `/service/web/state`, Value: `crashed`},
+				{Metric: `/service/web/pid`, Value: `123`},
+				{Metric: `/sys/os`, Value: `linux`},
+			},
+		}},
+	}
+	d.convertBatch(batch)
+	data := batch.Data[0]
+	if len(data.IntMetrics) != 2 || data.IntMetrics[0].Value != 1 ||
+		data.IntMetrics[1].Value != 123 {
+		t.Errorf("Converted metrics %+v", data.IntMetrics)
+	}
+	if len(data.StringMetrics) != 2 {
+		t.Errorf("Unconverted metrics %+v", data.StringMetrics)
+	}
+
+	tests := []struct {
+		split legacy.MetricSplit
+		typ   string
+		value int64
+	}{
+		{legacy.MetricSplit{Path: `/service/db/state`, Type: `string`,
+			Val: legacy.MetricValue{StrVal: `stopped`}}, `integer`, 0},
+		{legacy.MetricSplit{Path: `/service/db/state`, Type: `string`,
+			Val: legacy.MetricValue{StrVal: `crashed`}}, `string`, 0},
+		{legacy.MetricSplit{Path: `/sys/os`, Type: `string`,
+			Val: legacy.MetricValue{StrVal: `linux`}}, `string`, 0},
+		{legacy.MetricSplit{Path: `/service/db/state`, Type: `integer`,
+			Val: legacy.MetricValue{IntVal: 5}}, `integer`, 5},
+	}
+
+	for _, tc := range tests {
+		split := tc.split
+		d.convertSplit(&split)
+		if split.Type != tc.typ || split.Val.IntVal != tc.value {
+			t.Errorf("%s %q: converted to %s %d, expected %s %d",
+				tc.split.Path, tc.split.Val.StrVal, split.Type,
+				split.Val.IntVal, tc.typ, tc.value)
+		}
+	}
+
+	for name, expected := range map[string]int64{
+		`/convert/state/converted`:   2,
+		`/convert/state/unmapped`:    2,
+		`/convert/service/converted`: 1,
+	} {
+		if n := metrics.GetOrRegisterCounter(name,
+			*d.Metrics).Count(); n != expected {
+			t.Errorf("%s = %d, expected %d", name, n, expected)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,78 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/client9/reopen"
+	"github.com/mjolnir42/erebos"
+)
+
+// DeadLetter writes rejected metrics as newline delimited JSON to
+// the dead-letter file. It is shared by all handlers.
+type DeadLetter struct {
+	lock sync.Mutex
+	fh   *reopen.FileWriter
+}
+
+// deadLetterRecord is the format of a dead-letter file entry
+type deadLetterRecord struct {
+	HostID    int         `json:"hostID"`
+	Topic     string      `json:"topic"`
+	Partition int32       `json:"partition"`
+	Offset    int64       `json:"offset"`
+	Reason    string      `json:"reason"`
+	Data      interface{} `json:"data"`
+}
+
+// NewDeadLetter opens the dead-letter file configured in s. If no
+// file is configured, nil is returned.
+func NewDeadLetter(s *Settings) (*DeadLetter, error) {
+	if s.DustDevil.DeadLetterFile == `` {
+		return nil, nil
+	}
+
+	fh, err := reopen.NewFileWriter(s.DustDevil.DeadLetterFile)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetter{fh: fh}, nil
+}
+
+// write appends data, rejected from msg for reason, to the
+// dead-letter file
+func (l *DeadLetter) write(msg *erebos.Transport, hostID int, reason string, data interface{}) error {
+	buf, err := json.Marshal(deadLetterRecord{
+		HostID:    hostID,
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Reason:    reason,
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, err = l.fh.Write(append(buf, '\n'))
+	return err
+}
+
+// Reopen reopens the dead-letter file, ie. after it was rotated
+func (l *DeadLetter) Reopen() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.fh.Reopen()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
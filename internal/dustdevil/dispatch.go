@@ -12,18 +12,33 @@ import (
 	"runtime"
 
 	"github.com/mjolnir42/erebos"
-	"github.com/solnx/legacy"
 )
 
 // Dispatch implements erebos.Dispatcher
 func Dispatch(msg erebos.Transport) error {
+	var err error
+
+	// decompress the message payload, the handlers only receive
+	// uncompressed messages
+	if msg.Value, err = decompress(msg.Value,
+		settings.DustDevil.InputCompression); err != nil {
+		return err
+	}
+
 	// send all messages from the same host to the same
 	// handler to keep the ordering intact
-	hostID, err := legacy.PeekHostID(msg.Value)
+	var hostID int
+	hostID, err = peekHostID(msg.Value,
+		inputEncoding(settings, msg.Topic, msg.Value))
 	if err != nil {
 		return err
 	}
 	msg.HostID = hostID
+	offsets.consume(partitionKey{
+		topic:     msg.Topic,
+		partition: msg.Partition,
+	}, msg.Offset)
+	startTrace(&msg)
 
 	Handlers[hostID%runtime.NumCPU()].InputChannel() <- &msg
 	return nil
@@ -0,0 +1,325 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/solnx/legacy"
+)
+
+// series is the running aggregate of a numeric time series within
+// a window. Integer series keep integer min, max, sum and last.
+type series struct {
+	integer bool
+	count   int64
+	min     float64
+	max     float64
+	sum     float64
+	last    float64
+	imin    int64
+	imax    int64
+	isum    int64
+	ilast   int64
+	lastTS  time.Time
+}
+
+// window holds the aggregates of one host for one time window and
+// the commit groups of the messages they were built from
+type window struct {
+	hostID  int
+	start   time.Time
+	topic   string
+	series  map[seriesKey]*series
+	strings map[seriesKey]legacy.StringMetric
+	stringT map[seriesKey]time.Time
+	groups  map[*commitGroup]bool
+	// producer paths of the series and their aggregates
+	profiles *profileCache
+}
+
+// downsampler buckets the metrics of all hosts into fixed size time
+// windows
+type downsampler struct {
+	lock    sync.Mutex
+	size    time.Duration
+	grace   time.Duration
+	windows map[int]map[time.Time]*window
+}
+
+// newDownsampler returns a downsampler with windows of size that are
+// closed grace after their end
+func newDownsampler(size, grace time.Duration) *downsampler {
+	return &downsampler{
+		size:    size,
+		grace:   grace,
+		windows: make(map[int]map[time.Time]*window),
+	}
+}
+
+// add records the metrics of batch in their windows. For every
+// window that batch contributes to, the pending count of group is
+// incremented. The producer paths of the metrics are taken from
+// cache. add returns the number of samples that were dropped because
+// their window was already closed.
+func (s *downsampler) add(batch legacy.MetricBatch, topic string, group *commitGroup, cache *profileCache) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	late := 0
+	now := time.Now()
+	for _, data := range batch.Data {
+		start := data.Time.UTC().Truncate(s.size)
+		if s.closed(start, now) {
+			late += len(data.FloatMetrics) + len(data.IntMetrics) +
+				len(data.StringMetrics)
+			continue
+		}
+		w := s.window(batch.HostID, start, topic)
+		if !w.groups[group] {
+			w.groups[group] = true
+			atomic.AddInt32(&group.pending, 1)
+		}
+
+		for _, m := range data.FloatMetrics {
+			w.get(m.Metric, m.Subtype, false).addFloat(data.Time,
+				m.Value)
+			w.origin(cache, m.Metric, m.Subtype)
+		}
+		for _, m := range data.IntMetrics {
+			w.get(m.Metric, m.Subtype, true).addInt(data.Time,
+				m.Value)
+			w.origin(cache, m.Metric, m.Subtype)
+		}
+		for _, m := range data.StringMetrics {
+			w.origin(cache, m.Metric, m.Subtype)
+			key := seriesKey{path: m.Metric, subtype: m.Subtype}
+			if data.Time.Before(w.stringT[key]) {
+				continue
+			}
+			w.strings[key] = m
+			w.stringT[key] = data.Time
+		}
+	}
+	return late
+}
+
+// flush removes and returns all windows that are closed at time now,
+// ordered by window start
+func (s *downsampler) flush(now time.Time) []*window {
+	return s.take(func(start time.Time) bool {
+		return s.closed(start, now)
+	})
+}
+
+// drain removes and returns all windows, ordered by window start
+func (s *downsampler) drain() []*window {
+	return s.take(func(time.Time) bool {
+		return true
+	})
+}
+
+// take removes and returns all windows whose start is accepted by
+// done, ordered by window start
+func (s *downsampler) take(done func(start time.Time) bool) []*window {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	flushed := []*window{}
+	for hostID := range s.windows {
+		for start, w := range s.windows[hostID] {
+			if !done(start) {
+				continue
+			}
+			flushed = append(flushed, w)
+			delete(s.windows[hostID], start)
+		}
+		if len(s.windows[hostID]) == 0 {
+			delete(s.windows, hostID)
+		}
+	}
+	sort.Slice(flushed, func(i, j int) bool {
+		return flushed[i].start.Before(flushed[j].start)
+	})
+	return flushed
+}
+
+// closed returns true if the window starting at start no longer
+// accepts samples at time now
+func (s *downsampler) closed(start, now time.Time) bool {
+	return !now.Before(start.Add(s.size).Add(s.grace))
+}
+
+// window returns the window of hostID starting at start, which is
+// created if required
+func (s *downsampler) window(hostID int, start time.Time, topic string) *window {
+	if _, ok := s.windows[hostID]; !ok {
+		s.windows[hostID] = make(map[time.Time]*window)
+	}
+	w, ok := s.windows[hostID][start]
+	if !ok {
+		w = &window{
+			hostID:  hostID,
+			start:   start,
+			topic:   topic,
+			series:  make(map[seriesKey]*series),
+			strings: make(map[seriesKey]legacy.StringMetric),
+			stringT: make(map[seriesKey]time.Time),
+			groups:  make(map[*commitGroup]bool),
+			// aggregates are derived from the series when the
+			// window is delivered
+			profiles: newProfileCache(),
+		}
+		s.windows[hostID][start] = w
+	}
+	return w
+}
+
+// origin records the producer path of the series path and subtype
+// from cache
+func (w *window) origin(cache *profileCache, path, subtype string) {
+	if o := cache.origin(path, subtype); o != path {
+		w.profiles.origins[seriesKey{path: path, subtype: subtype}] = o
+	}
+}
+
+// get returns the series of path and subtype, which is created if
+// required
+func (w *window) get(path, subtype string, integer bool) *series {
+	key := seriesKey{path: path, subtype: subtype}
+	if _, ok := w.series[key]; !ok {
+		w.series[key] = &series{integer: integer}
+	}
+	return w.series[key]
+}
+
+// addFloat adds the sample value at ts to s
+func (s *series) addFloat(ts time.Time, value float64) {
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+	if s.count == 0 || value > s.max {
+		s.max = value
+	}
+	s.sum += value
+	if s.count == 0 || !ts.Before(s.lastTS) {
+		s.last = value
+		s.lastTS = ts
+	}
+	s.count++
+}
+
+// addInt adds the sample value at ts to s
+func (s *series) addInt(ts time.Time, value int64) {
+	if s.count == 0 || value < s.imin {
+		s.imin = value
+	}
+	if s.count == 0 || value > s.imax {
+		s.imax = value
+	}
+	s.isum += value
+	if s.count == 0 || !ts.Before(s.lastTS) {
+		s.ilast = value
+	}
+	s.addFloat(ts, float64(value))
+}
+
+// batch returns the aggregates of w as MetricBatch. Every function in
+// functions is emitted as metric with the function name appended to
+// the path. String metrics are forwarded with their last value.
+func (w *window) batch(functions []string) legacy.MetricBatch {
+	data := legacy.MetricData{
+		Time:          w.start,
+		FloatMetrics:  make([]legacy.FloatMetric, 0),
+		StringMetrics: make([]legacy.StringMetric, 0),
+		IntMetrics:    make([]legacy.IntMetric, 0),
+	}
+
+	keys := make([]seriesKey, 0, len(w.series))
+	for key := range w.series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		return keys[i].subtype < keys[j].subtype
+	})
+
+	for _, key := range keys {
+		s := w.series[key]
+		for _, fn := range functions {
+			path := fmt.Sprintf("%s/%s", key.path, fn)
+			w.profiles.derive(path, key.subtype, key.path, key.subtype)
+			switch {
+			case fn == `count`:
+				data.IntMetrics = append(data.IntMetrics,
+					legacy.IntMetric{Metric: path,
+						Subtype: key.subtype, Value: s.count})
+			case fn == `avg`:
+				data.FloatMetrics = append(data.FloatMetrics,
+					legacy.FloatMetric{Metric: path,
+						Subtype: key.subtype,
+						Value:   s.sum / float64(s.count)})
+			case s.integer:
+				data.IntMetrics = append(data.IntMetrics,
+					legacy.IntMetric{Metric: path,
+						Subtype: key.subtype, Value: s.intValue(fn)})
+			default:
+				data.FloatMetrics = append(data.FloatMetrics,
+					legacy.FloatMetric{Metric: path,
+						Subtype: key.subtype, Value: s.floatValue(fn)})
+			}
+		}
+	}
+
+	for _, m := range w.strings {
+		data.StringMetrics = append(data.StringMetrics, m)
+	}
+
+	return legacy.MetricBatch{
+		HostID:   w.hostID,
+		Protocol: 1,
+		Data:     []legacy.MetricData{data},
+	}
+}
+
+// floatValue returns the value of aggregate function fn
+func (s *series) floatValue(fn string) float64 {
+	switch fn {
+	case `min`:
+		return s.min
+	case `max`:
+		return s.max
+	case `sum`:
+		return s.sum
+	default:
+		return s.last
+	}
+}
+
+// intValue returns the value of aggregate function fn
+func (s *series) intValue(fn string) int64 {
+	switch fn {
+	case `min`:
+		return s.imin
+	case `max`:
+		return s.imax
+	case `sum`:
+		return s.isum
+	default:
+		return s.ilast
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,289 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/solnx/legacy"
+)
+
+func TestDownsampleAdd(t *testing.T) {
+	now := time.Now().UTC()
+	current := now.Truncate(time.Minute)
+
+	tests := []struct {
+		name string
+		// sample times of the batch
+		times []time.Time
+		late  int
+		// windows open afterwards and groups pending
+		windows int
+		pending int32
+	}{
+		{name: `current window`, times: []time.Time{now},
+			windows: 1, pending: 1},
+		{name: `same window twice`, times: []time.Time{current,
+			current.Add(time.Second)}, windows: 1, pending: 1},
+		{name: `previous window in grace`, times: []time.Time{now,
+			current.Add(-time.Second)}, windows: 2, pending: 2},
+		{name: `closed window`, times: []time.Time{now,
+			current.Add(-90 * time.Second)}, late: 2, windows: 1,
+			pending: 1},
+		{name: `only closed windows`, times: []time.Time{
+			current.Add(-5 * time.Minute)}, late: 2},
+	}
+
+	for _, tc := range tests {
+		s := newDownsampler(time.Minute, time.Minute)
+		batch := legacy.MetricBatch{HostID: 1}
+		for _, ts := range tc.times {
+			batch.Data = append(batch.Data, legacy.MetricData{
+				Time: ts,
+				FloatMetrics: []legacy.FloatMetric{
+					{Metric: `/sys/load`, Value: 1},
+				},
+				StringMetrics: []legacy.StringMetric{
+					{Metric: `/sys/os`, Value: `linux`},
+				},
+			})
+		}
+		group := &commitGroup{}
+
+		if late := s.add(batch, `metrics`, group, newProfileCache()); late != tc.late {
+			t.Errorf("%s: %d late samples, expected %d", tc.name,
+				late, tc.late)
+		}
+		if n := len(s.windows[1]); n != tc.windows {
+			t.Errorf("%s: %d windows, expected %d", tc.name, n,
+				tc.windows)
+		}
+		if group.pending != tc.pending {
+			t.Errorf("%s: %d pending, expected %d", tc.name,
+				group.pending, tc.pending)
+		}
+	}
+}
+
+func TestDownsampleFlush(t *testing.T) {
+	now := time.Now().UTC()
+	current := now.Truncate(time.Minute)
+	s := newDownsampler(time.Minute, time.Minute)
+
+	for hostID, ts := range map[int]time.Time{
+		1: now,
+		2: current.Add(-time.Second),
+	} {
+		s.add(legacy.MetricBatch{
+			HostID: hostID,
+			Data: []legacy.MetricData{{
+				Time: ts,
+				IntMetrics: []legacy.IntMetric{
+					{Metric: `/sys/processes`, Value: 1},
+				},
+			}},
+		}, `metrics`, &commitGroup{}, newProfileCache())
+	}
+
+	tests := []struct {
+		now     time.Time
+		flushed []int
+	}{
+		{now: now, flushed: []int{}},
+		{now: current.Add(time.Minute), flushed: []int{2}},
+		{now: current.Add(time.Minute), flushed: []int{}},
+		{now: current.Add(2 * time.Minute), flushed: []int{1}},
+	}
+
+	for i, tc := range tests {
+		flushed := s.flush(tc.now)
+		if len(flushed) != len(tc.flushed) {
+			t.Errorf("Flush %d: %d windows, expected %d", i,
+				len(flushed), len(tc.flushed))
+			continue
+		}
+		for j := range flushed {
+			if flushed[j].hostID != tc.flushed[j] {
+				t.Errorf("Flush %d: window of host %d, expected %d",
+					i, flushed[j].hostID, tc.flushed[j])
+			}
+		}
+	}
+	if len(s.windows) != 0 {
+		t.Errorf("%d hosts left after flushing", len(s.windows))
+	}
+}
+
+// TestDownsampleShutdown checks that open windows are delivered and
+// their messages committed when the handler shuts down
+func TestDownsampleShutdown(t *testing.T) {
+	sink := newTestSink(t, http.StatusOK)
+	d := newUnstartedHandler(t, `batch`, false, sink.URL,
+		`"downsample.window.seconds":"3600"`)
+	done := make(chan struct{})
+	go func() {
+		d.Start()
+		close(done)
+	}()
+
+	msg := testMessage(t, 3, 1, &legacy.MetricBatch{
+		HostID: 3,
+		Data: []legacy.MetricData{{
+			Time: time.Now().UTC(),
+			IntMetrics: []legacy.IntMetric{
+				{Metric: `/sys/processes`, Value: 1},
+			},
+		}},
+	})
+	d.Input <- msg
+	close(d.Shutdown)
+	close(d.Input)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`Handler did not shut down`)
+	}
+
+	if n := len(sink.posts()); n != 1 {
+		t.Errorf("Received %d POST requests, expected 1", n)
+	}
+	if committed(msg) != 1 {
+		t.Error(`Message of the drained window was not committed`)
+	}
+}
+
+func TestWindowBatch(t *testing.T) {
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	w := newDownsampler(time.Minute, 0).window(1, start, `metrics`)
+
+	// samples are added out of order, last follows the timestamps
+	for _, sample := range []struct {
+		offset int
+		value  int64
+	}{{10, 4}, {30, 2}, {20, 9}} {
+		ts := start.Add(time.Duration(sample.offset) * time.Second)
+		w.get(`/int`, ``, true).addInt(ts, sample.value)
+		w.get(`/float`, `a`, false).addFloat(ts,
+			float64(sample.value)/2)
+	}
+
+	functions := []string{`min`, `max`, `avg`, `sum`, `count`, `last`}
+	batch := w.batch(functions)
+	data := batch.Data[0]
+	if batch.HostID != 1 || !data.Time.Equal(start) {
+		t.Fatalf("Batch of host %d at %s", batch.HostID, data.Time)
+	}
+
+	ints := map[string]int64{}
+	for _, m := range data.IntMetrics {
+		ints[m.Metric] = m.Value
+	}
+	floats := map[string]float64{}
+	for _, m := range data.FloatMetrics {
+		floats[m.Metric+`:`+m.Subtype] = m.Value
+	}
+
+	tests := []struct {
+		metric  string
+		integer bool
+		value   float64
+	}{
+		{`/int/min`, true, 2},
+		{`/int/max`, true, 9},
+		{`/int/sum`, true, 15},
+		{`/int/count`, true, 3},
+		{`/int/last`, true, 2},
+		{`/int/avg:`, false, 5},
+		{`/float/min:a`, false, 1},
+		{`/float/max:a`, false, 4.5},
+		{`/float/sum:a`, false, 7.5},
+		{`/float/count`, true, 3},
+		{`/float/last:a`, false, 1},
+		{`/float/avg:a`, false, 2.5},
+	}
+
+	for _, tc := range tests {
+		var value float64
+		var ok bool
+		if tc.integer {
+			var i int64
+			i, ok = ints[tc.metric]
+			value = float64(i)
+		} else {
+			value, ok = floats[tc.metric]
+		}
+		if !ok || value != tc.value {
+			t.Errorf("%s = %f (%t), expected %f", tc.metric, value,
+				ok, tc.value)
+		}
+	}
+	if n := len(data.IntMetrics) + len(data.FloatMetrics); n !=
+		len(tests) {
+		t.Errorf("Batch has %d metrics, expected %d", n, len(tests))
+	}
+}
+
+func TestDownsampleStrings(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Minute)
+	s := newDownsampler(time.Minute, time.Minute)
+
+	for _, sample := range []struct {
+		offset int
+		value  string
+	}{{20, `new`}, {10, `old`}} {
+		s.add(legacy.MetricBatch{
+			HostID: 1,
+			Data: []legacy.MetricData{{
+				Time: now.Add(time.Duration(sample.offset) *
+					time.Second),
+				StringMetrics: []legacy.StringMetric{
+					{Metric: `/sys/os`, Value: sample.value},
+				},
+			}},
+		}, `metrics`, &commitGroup{}, newProfileCache())
+	}
+
+	batch := s.windows[1][now].batch([]string{`last`})
+	strs := batch.Data[0].StringMetrics
+	if len(strs) != 1 || strs[0].Value != `new` {
+		t.Errorf("String metrics %+v, expected the newest", strs)
+	}
+}
+
+func TestDownsampleFunctionsSetting(t *testing.T) {
+	tests := []struct {
+		options   string
+		valid     bool
+		functions int
+	}{
+		{options: ``, valid: true, functions: 6},
+		{options: `"downsample.functions":["min","max"]`, valid: true,
+			functions: 2},
+		{options: `"downsample.functions":["median"]`, valid: false},
+	}
+
+	for _, tc := range tests {
+		s := &Settings{}
+		err := s.fromJSON([]byte(`{"dustdevil":{` + tc.options + `}}`))
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: valid=%t, error: %v", tc.options, tc.valid,
+				err)
+			continue
+		}
+		if tc.valid &&
+			len(s.DustDevil.DownsampleFunctions) != tc.functions {
+			t.Errorf("%s: %d functions, expected %d", tc.options,
+				len(s.DustDevil.DownsampleFunctions), tc.functions)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/go-resty/resty"
+	"github.com/klauspost/compress/zstd"
 	"github.com/mjolnir42/delay"
 	"github.com/mjolnir42/erebos"
 	"github.com/mjolnir42/limit"
@@ -29,6 +30,12 @@ func init() {
 	Handlers = make(map[int]erebos.Handler)
 }
 
+// thresholdLookup looks up the eyewall thresholds of a lookup ID. It
+// is implemented by wall.Lookup.
+type thresholdLookup interface {
+	LookupThreshold(string) (map[string]wall.Threshold, error)
+}
+
 // DustDevil forwars received messages to an HTTP endpoint
 type DustDevil struct {
 	Num      int
@@ -36,15 +43,38 @@ type DustDevil struct {
 	Shutdown chan struct{}
 	Death    chan error
 	Config   *erebos.Config
+	Settings *Settings
 	Metrics  *metrics.Registry
 	Limit    *limit.Limit
+	Pool     *Pool
+	// DeadLetter is nil if no dead-letter file is configured
+	DeadLetter *DeadLetter
+	// Throttle is nil if no rate limit is configured
+	Throttle *Throttle
+	Health   *Health
+	Stats    *HostStats
 	// unexported
 	client         *resty.Client
+	zstdEncoder    *zstd.Encoder
 	delay          *delay.Delay
 	lookup         *wall.Lookup
+	thresholds     thresholdLookup
 	assembly       map[int]map[time.Time]legacy.MetricData
 	assemblyLock   sync.Mutex
 	assemblyCommit map[int][]*erebos.Transport
+	// profile lookups and producer paths of the assembled metrics
+	assemblyProfiles map[int]*profileCache
+	// aggregation buffers of processBatch by endpoint
+	aggregation     map[string]*aggregation
+	aggregationLock sync.Mutex
+	// last counter samples for rate conversion
+	rates *rateState
+	// downsampling windows, nil if downsampling is disabled
+	downsample *downsampler
+	// requests currently sent by the handler
+	inflight int64
+	// functions run in the event loop on behalf of the admin API
+	controlC chan func()
 }
 
 // commit marks a message as fully processed
@@ -54,6 +84,25 @@ func (d *DustDevil) commit(msg *erebos.Transport) {
 		Partition: msg.Partition,
 		Offset:    msg.Offset,
 	}
+	metrics.GetOrRegisterCounter(`/input/committed`,
+		*d.Metrics).Inc(1)
+	d.trackCommitted(msg)
+	endTrace(msg)
+}
+
+// countMetrics returns the number of metrics in batch and the
+// newest timestamp
+func countMetrics(batch legacy.MetricBatch) (int, time.Time) {
+	n := 0
+	var ts time.Time
+	for _, data := range batch.Data {
+		n += len(data.FloatMetrics) + len(data.IntMetrics) +
+			len(data.StringMetrics)
+		if data.Time.After(ts) {
+			ts = data.Time
+		}
+	}
+	return n, ts
 }
 
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,351 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// aggregateEntry is a marshalled MetricBatch that is sent as part of
+// an aggregated request
+type aggregateEntry struct {
+	hostID   int
+	route    string
+	endpoint string
+	body     []byte
+	group    *commitGroup
+	// timestamps of the contained MetricData
+	times []time.Time
+	// number of contained metrics
+	count int
+}
+
+// aggregation buffers aggregateEntry for one endpoint until they are
+// sent
+type aggregation struct {
+	entries []aggregateEntry
+	size    int
+}
+
+// commitGroup holds the messages whose content was split across
+// several requests. The messages are committed once all requests
+// have succeeded.
+type commitGroup struct {
+	pending int32
+	msgs    []*erebos.Transport
+}
+
+// commitDone marks one request of group g as successful and commits
+// the messages of g after the last one
+func (d *DustDevil) commitDone(g *commitGroup) {
+	if atomic.AddInt32(&g.pending, -1) != 0 {
+		return
+	}
+	for i := range g.msgs {
+		msg := g.msgs[i]
+		d.delay.Go(func() {
+			d.commit(msg)
+		})
+	}
+}
+
+// aggregateBatch splits batch by endpoint and adds the parts to the
+// aggregation buffers. msg is committed once all parts have been
+// sent.
+func (d *DustDevil) aggregateBatch(batch legacy.MetricBatch, msg *erebos.Transport) {
+	routed, err := d.route(batch, msg.Topic)
+	if err != nil {
+		// signal main to shut down
+		d.Death <- d.fail(err, msg)
+		<-d.Shutdown
+		return
+	}
+
+	entries := make([]aggregateEntry, 0, len(routed))
+	group := &commitGroup{
+		pending: int32(len(routed)),
+		msgs:    []*erebos.Transport{msg},
+	}
+	for _, rb := range routed {
+		count, _ := countMetrics(rb.batch)
+		var outMsg []byte
+		if outMsg, err = rb.batch.MarshalJSON(); err != nil {
+			// signal main to shut down
+			d.Death <- d.fail(err, msg)
+			<-d.Shutdown
+			return
+		}
+		entries = append(entries, aggregateEntry{
+			hostID:   batch.HostID,
+			route:    rb.route,
+			endpoint: rb.endpoint,
+			body:     outMsg,
+			group:    group,
+			times:    batchTimes(rb.batch),
+			count:    count,
+		})
+	}
+
+	if len(entries) == 0 {
+		// nothing to forward
+		d.delay.Go(func() {
+			d.commit(msg)
+		})
+		return
+	}
+	for _, e := range entries {
+		d.aggregate(e)
+	}
+}
+
+// aggregate adds e to the aggregation buffer of processBatch and sends
+// the buffer if it is full
+func (d *DustDevil) aggregate(e aggregateEntry) {
+	var overflow, full []aggregateEntry
+
+	d.aggregationLock.Lock()
+	buf, ok := d.aggregation[e.endpoint]
+	if !ok {
+		buf = &aggregation{entries: make([]aggregateEntry, 0)}
+		d.aggregation[e.endpoint] = buf
+	}
+	// adding e would overflow the request, send the buffer first
+	if len(buf.entries) > 0 &&
+		buf.size+len(e.body) > d.Settings.DustDevil.AggregateMaxBytes {
+		overflow = buf.take()
+	}
+	buf.entries = append(buf.entries, e)
+	buf.size += len(e.body)
+	if len(buf.entries) >= d.Settings.DustDevil.AggregateMaxHosts ||
+		buf.size >= d.Settings.DustDevil.AggregateMaxBytes {
+		full = buf.take()
+	}
+	d.aggregationLock.Unlock()
+
+	if len(overflow) > 0 {
+		d.sendAggregation(overflow)
+	}
+	if len(full) > 0 {
+		d.sendAggregation(full)
+	}
+}
+
+// flushAggregation sends all aggregation buffers of processBatch
+func (d *DustDevil) flushAggregation() {
+	send := [][]aggregateEntry{}
+
+	d.aggregationLock.Lock()
+	for endpoint := range d.aggregation {
+		if len(d.aggregation[endpoint].entries) > 0 {
+			send = append(send, d.aggregation[endpoint].take())
+		}
+	}
+	d.aggregationLock.Unlock()
+
+	for _, entries := range send {
+		d.sendAggregation(entries)
+	}
+}
+
+// take returns the buffered entries and resets the buffer
+func (a *aggregation) take() []aggregateEntry {
+	entries := a.entries
+	a.entries = make([]aggregateEntry, 0)
+	a.size = 0
+	return entries
+}
+
+// sendAggregation sends entries as a single request and commits the
+// contained messages on success
+func (d *DustDevil) sendAggregation(entries []aggregateEntry) {
+	if err := d.postAggregate(entries); err != nil {
+		// signal main to shut down
+		d.Death <- d.fail(err, nil)
+		<-d.Shutdown
+		return
+	}
+
+	for _, e := range entries {
+		d.commitDone(e.group)
+	}
+}
+
+// releaseAggregated is the variant of release that packs the
+// assembled MetricBatch of several hosts into aggregated requests
+func (d *DustDevil) releaseAggregated() {
+	entries := []aggregateEntry{}
+	hostIDs := []int{}
+	for hostID := range d.assembly {
+		if len(d.assembly[hostID]) == 0 {
+			continue
+		}
+		hostIDs = append(hostIDs, hostID)
+
+		routed, err := d.route(d.assembledBatch(hostID),
+			d.assemblyTopic(hostID))
+		if err != nil {
+			// signal main to shut down
+			d.Death <- d.fail(withFields(err, logrus.Fields{
+				`hostID`: hostID,
+			}), nil)
+			<-d.Shutdown
+			return
+		}
+
+		group := &commitGroup{
+			pending: int32(len(routed)),
+			msgs:    d.assemblyCommit[hostID],
+		}
+		if len(routed) == 0 {
+			// nothing to forward for hostID
+			group.pending = 1
+			d.commitDone(group)
+		}
+		for _, rb := range routed {
+			count, _ := countMetrics(rb.batch)
+			outMsg, err := rb.batch.MarshalJSON()
+			if err != nil {
+				// signal main to shut down
+				d.Death <- d.fail(withFields(err, logrus.Fields{
+					`hostID`: hostID,
+				}), nil)
+				<-d.Shutdown
+				return
+			}
+			entries = append(entries, aggregateEntry{
+				hostID:   hostID,
+				route:    rb.route,
+				endpoint: rb.endpoint,
+				body:     outMsg,
+				group:    group,
+				times:    batchTimes(rb.batch),
+				count:    count,
+			})
+		}
+	}
+
+	for _, chunk := range d.splitAggregation(entries) {
+		if err := d.postAggregate(chunk); err != nil {
+			// signal main to shut down
+			d.Death <- d.fail(err, nil)
+			<-d.Shutdown
+			return
+		}
+		for _, e := range chunk {
+			d.commitDone(e.group)
+		}
+	}
+
+	for _, hostID := range hostIDs {
+		// clear message store for hostID
+		delete(d.assembly, hostID)
+		delete(d.assemblyProfiles, hostID)
+
+		// clear transport wrapper store for hostID
+		d.assemblyCommit[hostID] = make([]*erebos.Transport, 0)
+	}
+}
+
+// splitAggregation packs entries into chunks that each fit into one
+// aggregated request to a single endpoint
+func (d *DustDevil) splitAggregation(entries []aggregateEntry) [][]aggregateEntry {
+	chunks := [][]aggregateEntry{}
+	buffers := map[string]*aggregation{}
+
+	for _, e := range entries {
+		buf, ok := buffers[e.endpoint]
+		if !ok {
+			buf = &aggregation{entries: make([]aggregateEntry, 0)}
+			buffers[e.endpoint] = buf
+		}
+		if len(buf.entries) > 0 && (len(buf.entries) >=
+			d.Settings.DustDevil.AggregateMaxHosts ||
+			buf.size+len(e.body) > d.Settings.DustDevil.AggregateMaxBytes) {
+			chunks = append(chunks, buf.take())
+		}
+		buf.entries = append(buf.entries, e)
+		buf.size += len(e.body)
+	}
+	for endpoint := range buffers {
+		if len(buffers[endpoint].entries) > 0 {
+			chunks = append(chunks, buffers[endpoint].take())
+		}
+	}
+	return chunks
+}
+
+// postAggregate sends entries as a single request to their shared
+// endpoint, either as JSON array or as newline delimited JSON
+func (d *DustDevil) postAggregate(entries []aggregateEntry) error {
+	var (
+		body        []byte
+		contentType string
+	)
+
+	bodies := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		bodies = append(bodies, e.body)
+	}
+
+	switch d.Settings.DustDevil.AggregateFormat {
+	case `ndjson`:
+		body = append(bytes.Join(bodies, []byte("\n")), '\n')
+		contentType = `application/x-ndjson`
+	default:
+		body = append([]byte{'['}, bytes.Join(bodies, []byte{','})...)
+		body = append(body, ']')
+		contentType = `application/json`
+	}
+
+	// make HTTP POST request
+	resp, err := d.post(&request{
+		ctx:         traceContext(entries[0].group.msgs[0]),
+		hostID:      entries[0].hostID,
+		endpoint:    entries[0].endpoint,
+		route:       entries[0].route,
+		body:        body,
+		contentType: contentType,
+	})
+
+	// check HTTP response
+	if err != nil {
+		d.failedAggregate(entries)
+		return err
+	}
+	if resp.StatusCode() > 299 {
+		d.failedAggregate(entries)
+		return statusError(resp, `HTTP`)
+	}
+
+	metrics.GetOrRegisterMeter(`/output/messages.per.second`,
+		*d.Metrics).Mark(int64(len(entries)))
+	d.markRoute(entries[0].route)
+	for _, e := range entries {
+		d.Stats.forwarded(e.hostID, e.count)
+		d.observeDelay(e.times...)
+	}
+	return nil
+}
+
+// failedAggregate records the failed delivery of entries in the host
+// statistics
+func (d *DustDevil) failedAggregate(entries []aggregateEntry) {
+	for _, e := range entries {
+		d.Stats.failed(e.hostID)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -9,8 +9,6 @@
 package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
 
 import (
-	"encoding/json"
-	"fmt"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -21,38 +19,92 @@ import (
 // assembleSplit is the handler for assembling MetricSplit messages
 func (d *DustDevil) assembleSplit(msg *erebos.Transport) {
 	if msg == nil || msg.Value == nil {
-		logrus.Warnf("Ignoring empty message from: %d", msg.HostID)
+		logrus.WithFields(d.msgFields(msg)).Warnln(
+			`Ignoring empty message`)
 		if msg != nil {
 			d.commit(msg)
 		}
 		return
 	}
 
-	// handle heartbeat messages
-	if erebos.IsHeartbeat(msg) {
+	// unmarshal message
+	var err error
+	var split legacy.MetricSplit
+	if split, err = d.decodeSplit(msg); err != nil {
+		// signal main to shut down
+		d.Death <- d.fail(err, msg)
+		<-d.Shutdown
+		return
+	}
+
+	if len(split.Tags) == 0 {
+		split.Tags = []string{``}
+	}
+	d.Stats.received(msg.HostID, 1, split.TS)
+
+	// convert string metrics with conversion rule, the remaining
+	// ones are subject to stripping
+	d.convertSplit(&split)
+
+	// skip string metric reassembly if they are to be stripped,
+	// commit and return
+	if d.Config.DustDevil.StripStringMetrics && split.Type == `string` {
+		d.Stats.dropped(msg.HostID, 0, 1)
 		d.delay.Go(func() {
-			d.lookup.Heartbeat(func() string {
-				switch d.Config.Misc.InstanceName {
-				case ``:
-					return `dustdevil`
-				default:
-					return fmt.Sprintf("dustdevil/%s",
-						d.Config.Misc.InstanceName)
-				}
-			}(), d.Num, msg.Value)
+			d.commit(msg)
 		})
 		return
 	}
 
-	// unmarshal message
-	var err error
-	split := legacy.MetricSplit{}
-	if err = json.Unmarshal(msg.Value, &split); err != nil {
+	// check the timestamp against the acceptance window, commit and
+	// return if it is rejected
+	var keep bool
+	if keep, err = d.checkSplitTime(&split, msg); err != nil {
+		// signal main to shut down
+		d.Death <- d.fail(err, msg)
+		<-d.Shutdown
+		return
+	}
+	if !keep {
+		d.Stats.dropped(msg.HostID, 1, 0)
+		d.delay.Go(func() {
+			d.commit(msg)
+		})
+		return
+	}
+
+	// apply the filter rules and eyewall profile requirement, commit
+	// and return if nothing is left. The profile cache of hostID is
+	// only kept once a metric is assembled.
+	profiles, ok := d.assemblyProfiles[msg.HostID]
+	if !ok {
+		profiles = newProfileCache()
+	}
+	d.filterSplit(&split)
+	if len(split.Tags) == 0 ||
+		d.unconfigured(profiles, msg.HostID, split.Path, ``) {
+		d.Stats.dropped(msg.HostID, 1, 0)
+		d.delay.Go(func() {
+			d.commit(msg)
+		})
+		return
+	}
+
+	// apply sampling and rate limits, commit and return if the
+	// metric is discarded
+	if keep, err = d.throttleSplit(&split, msg); err != nil {
 		// signal main to shut down
-		d.Death <- err
+		d.Death <- d.fail(err, msg)
 		<-d.Shutdown
 		return
 	}
+	if !keep {
+		d.Stats.dropped(msg.HostID, 1, 0)
+		d.delay.Go(func() {
+			d.commit(msg)
+		})
+		return
+	}
 
 	// check data structures are set up
 	if _, ok := d.assembly[msg.HostID]; !ok {
@@ -69,42 +121,40 @@ func (d *DustDevil) assembleSplit(msg *erebos.Transport) {
 	if _, ok := d.assemblyCommit[msg.HostID]; !ok {
 		d.assemblyCommit[msg.HostID] = make([]*erebos.Transport, 0)
 	}
+	d.assemblyProfiles[msg.HostID] = profiles
 
-	// skip string metric reassembly if they are to be stripped,
-	// commit and return
-	if d.Config.DustDevil.StripStringMetrics && split.Type == `string` {
-		d.delay.Go(func() {
-			d.commit(msg)
-		})
-		return
-	}
-
-	if len(split.Tags) == 0 {
-		split.Tags = []string{``}
-	}
-
+	// relabel and convert counters to rates, the script is applied
+	// to the assembled batch on release
 	for _, tag := range split.Tags {
 		m := d.assembly[msg.HostID][split.TS]
+		path, subtype := d.relabelSeries(profiles, split.Path, tag)
 		switch split.Type {
 		case `real`:
 			m.FloatMetrics = append(m.FloatMetrics,
 				legacy.FloatMetric{
-					Metric:  split.Path,
-					Subtype: tag,
+					Metric:  path,
+					Subtype: subtype,
 					Value:   split.Val.FlpVal,
 				})
 		case `integer`, `long`:
-			m.IntMetrics = append(m.IntMetrics,
-				legacy.IntMetric{
-					Metric:  split.Path,
-					Subtype: tag,
-					Value:   split.Val.IntVal,
-				})
+			im := legacy.IntMetric{
+				Metric:  path,
+				Subtype: subtype,
+				Value:   split.Val.IntVal,
+			}
+			if rate, ok := d.counterRate(profiles, msg.HostID,
+				split.TS, im); ok {
+				m.FloatMetrics = append(m.FloatMetrics, rate)
+			}
+			if d.Settings.DustDevil.RateKeepCounters ||
+				!d.isCounter(path) {
+				m.IntMetrics = append(m.IntMetrics, im)
+			}
 		case `string`:
 			m.StringMetrics = append(m.StringMetrics,
 				legacy.StringMetric{
-					Metric:  split.Path,
-					Subtype: tag,
+					Metric:  path,
+					Subtype: subtype,
 					Value:   split.Val.StrVal,
 				})
 		}
@@ -114,6 +164,7 @@ func (d *DustDevil) assembleSplit(msg *erebos.Transport) {
 		d.assemblyCommit[msg.HostID],
 		msg,
 	)
+	traceEvent(msg, `assembled`)
 }
 
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,80 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// convertString returns the integer value of the string metric
+// metricPath with value. Strings without conversion rule or without
+// mapped value are not converted.
+func (d *DustDevil) convertString(metricPath, value string) (int64, bool) {
+	c := d.Settings.conversion(metricPath)
+	if c == nil {
+		return 0, false
+	}
+	num, ok := c.convert(value)
+	if !ok {
+		metrics.GetOrRegisterCounter(
+			fmt.Sprintf("/convert/%s/unmapped", c.name),
+			*d.Metrics).Inc(1)
+		return 0, false
+	}
+	metrics.GetOrRegisterCounter(
+		fmt.Sprintf("/convert/%s/converted", c.name),
+		*d.Metrics).Inc(1)
+	return num, true
+}
+
+// convertBatch converts the string metrics of batch that have a
+// conversion rule into integer metrics
+func (d *DustDevil) convertBatch(batch *legacy.MetricBatch) {
+	if len(d.Settings.conversions) == 0 {
+		return
+	}
+
+	for i := range batch.Data {
+		strs := make([]legacy.StringMetric, 0,
+			len(batch.Data[i].StringMetrics))
+		for _, m := range batch.Data[i].StringMetrics {
+			num, ok := d.convertString(m.Metric, m.Value)
+			if !ok {
+				strs = append(strs, m)
+				continue
+			}
+			batch.Data[i].IntMetrics = append(batch.Data[i].IntMetrics,
+				legacy.IntMetric{
+					Metric:  m.Metric,
+					Subtype: m.Subtype,
+					Value:   num,
+				})
+		}
+		batch.Data[i].StringMetrics = strs
+	}
+}
+
+// convertSplit converts split into an integer metric if it is a
+// string metric with conversion rule
+func (d *DustDevil) convertSplit(split *legacy.MetricSplit) {
+	if split.Type != `string` || len(d.Settings.conversions) == 0 {
+		return
+	}
+
+	if num, ok := d.convertString(split.Path,
+		split.Val.StrVal); ok {
+		split.Type = `integer`
+		split.Val.IntVal = num
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,49 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// decodeBatch unmarshals the MetricBatch contained in msg. The
+// payload has already been decompressed by Dispatch and
+// is decoded according to its wire format.
+func (d *DustDevil) decodeBatch(msg *erebos.Transport) (legacy.MetricBatch, error) {
+	batch := legacy.MetricBatch{}
+	err := unmarshal(msg.Value,
+		inputEncoding(d.Settings, msg.Topic, msg.Value), &batch)
+	if err != nil {
+		d.decodeError()
+	}
+	return batch, err
+}
+
+// decodeSplit unmarshals the MetricSplit contained in msg. The
+// payload has already been decompressed by Dispatch and
+// is decoded according to its wire format.
+func (d *DustDevil) decodeSplit(msg *erebos.Transport) (legacy.MetricSplit, error) {
+	split := legacy.MetricSplit{}
+	err := unmarshal(msg.Value,
+		inputEncoding(d.Settings, msg.Topic, msg.Value), &split)
+	if err != nil {
+		d.decodeError()
+	}
+	return split, err
+}
+
+// decodeError counts a message that could not be decoded
+func (d *DustDevil) decodeError() {
+	metrics.GetOrRegisterCounter(`/input/decode.errors`,
+		*d.Metrics).Inc(1)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,104 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-resty/resty"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// deliver forwards batch to the endpoints of its routes, either as
+// MetricBatch or as Elasticsearch documents. The requests are traced
+// as part of ctx. Profile lookups of the batch already done are
+// taken from cache.
+func (d *DustDevil) deliver(ctx context.Context, batch legacy.MetricBatch, topic string, cache *profileCache) error {
+	out := metrics.GetOrRegisterMeter(`/output/messages.per.second`,
+		*d.Metrics)
+
+	// split the batch by endpoint
+	routed, err := d.route(batch, topic)
+	if err != nil {
+		return err
+	}
+
+	for i := range routed {
+		var docs [][]byte
+		switch d.Config.DustDevil.ForwardElastic {
+		case true:
+			// convert to marshalled []MetricElastic
+			if docs, err = d.elasticDocuments(
+				&routed[i].batch, cache); err != nil {
+				return err
+			}
+		default:
+			var outMsg []byte
+			if outMsg, err = routed[i].batch.MarshalJSON(); err != nil {
+				return err
+			}
+			docs = [][]byte{outMsg}
+		}
+
+		for _, outMsg := range docs {
+			// make HTTP POST request
+			var resp *resty.Response
+			resp, err = d.post(&request{
+				ctx:      ctx,
+				hostID:   batch.HostID,
+				endpoint: routed[i].endpoint,
+				route:    routed[i].route,
+				body:     outMsg,
+			})
+
+			// check HTTP response error
+			if err != nil {
+				d.Stats.failed(batch.HostID)
+				return err
+			}
+
+			// check HTTP response statuscode
+			if resp.StatusCode() > 299 {
+				d.Stats.failed(batch.HostID)
+				if d.Config.DustDevil.ForwardElastic {
+					return statusError(resp, `ES HTTP`)
+				}
+				return statusError(resp, `HTTP`)
+			}
+
+			// every Elasticsearch document is an outgoing message
+			if d.Config.DustDevil.ForwardElastic {
+				out.Mark(1)
+			}
+			d.markRoute(routed[i].route)
+		}
+		forwarded, _ := countMetrics(routed[i].batch)
+		d.Stats.forwarded(batch.HostID, forwarded)
+		d.observeDelay(batchTimes(routed[i].batch)...)
+	}
+
+	if !d.Config.DustDevil.ForwardElastic {
+		out.Mark(1)
+	}
+	return nil
+}
+
+// statusError returns the error for an unsuccessful HTTP response
+func statusError(resp *resty.Response, kind string) error {
+	return withFields(fmt.Errorf("%s response was: %s", kind,
+		resp.Status()), logrus.Fields{
+		`endpoint`: resp.Request.URL,
+		`status`:   resp.StatusCode(),
+	})
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,97 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"context"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// downsampleBatch adds batch to the downsampling windows. The
+// messages msgs are committed once every window they contributed to
+// has been delivered. The producer paths of the metrics are taken
+// from cache.
+func (d *DustDevil) downsampleBatch(batch legacy.MetricBatch, topic string, msgs []*erebos.Transport, cache *profileCache) {
+	// the group starts out pending to not be committed while it is
+	// still being added to windows
+	group := &commitGroup{
+		pending: 1,
+		msgs:    msgs,
+	}
+
+	if late := d.downsample.add(batch, topic, group, cache); late > 0 {
+		metrics.GetOrRegisterCounter(`/downsample/late.dropped`,
+			*d.Metrics).Inc(int64(late))
+	}
+	d.commitDone(group)
+}
+
+// releaseDownsampled is the variant of release that moves the
+// assembled MetricBatch of all hosts into the downsampling windows
+func (d *DustDevil) releaseDownsampled() {
+	for hostID := range d.assembly {
+		if len(d.assembly[hostID]) > 0 {
+			d.downsampleBatch(d.assembledBatch(hostID),
+				d.assemblyTopic(hostID), d.assemblyCommit[hostID],
+				d.assemblyProfiles[hostID])
+		}
+
+		// clear message store for hostID
+		delete(d.assembly, hostID)
+		delete(d.assemblyProfiles, hostID)
+
+		// clear transport wrapper store for hostID
+		d.assemblyCommit[hostID] = make([]*erebos.Transport, 0)
+	}
+}
+
+// flushDownsample delivers the aggregates of all closed windows and
+// commits the messages they were built from
+func (d *DustDevil) flushDownsample() {
+	d.deliverWindows(d.downsample.flush(time.Now()))
+}
+
+// drainDownsample delivers the aggregates of all windows on shutdown,
+// including the ones that are still open
+func (d *DustDevil) drainDownsample() {
+	d.deliverWindows(d.downsample.drain())
+}
+
+// deliverWindows delivers the aggregates of windows and commits the
+// messages they were built from
+func (d *DustDevil) deliverWindows(windows []*window) {
+	for _, w := range windows {
+		batch := w.batch(d.Settings.DustDevil.DownsampleFunctions)
+		// windows combine many messages, their delivery is traced
+		// separately
+		if err := d.deliver(context.Background(), batch, w.topic,
+			w.profiles); err != nil {
+			// signal main to shut down
+			d.Death <- d.fail(withFields(err, logrus.Fields{
+				`hostID`: w.hostID,
+				`topic`:  w.topic,
+			}), nil)
+			<-d.Shutdown
+			return
+		}
+
+		metrics.GetOrRegisterMeter(`/downsample/windows.per.second`,
+			*d.Metrics).Mark(1)
+		for g := range w.groups {
+			d.commitDone(g)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,276 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"encoding/json"
+
+	"github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/legacy"
+)
+
+// profile is the eyewall configuration data attached to enriched
+// documents
+type profile struct {
+	ConfigurationID string           `json:"configuration_id"`
+	Oncall          string           `json:"oncall,omitempty"`
+	Predicate       string           `json:"predicate,omitempty"`
+	Thresholds      map[string]int64 `json:"thresholds,omitempty"`
+}
+
+// elasticFields has the fields of legacy.MetricElastic without its
+// methods, so that they are marshalled inline into enrichedDocument
+type elasticFields legacy.MetricElastic
+
+// enrichedDocument is an Elasticsearch document with the eyewall
+// profiles of its metric
+type enrichedDocument struct {
+	elasticFields
+	Profiles []profile `json:"profiles"`
+}
+
+// profileKey identifies the metric path of a host
+type profileKey struct {
+	hostID int
+	path   string
+}
+
+// profileResult is a cached result of profiles
+type profileResult struct {
+	profiles   []profile
+	configured bool
+}
+
+// seriesKey identifies a time series of a host
+type seriesKey struct {
+	path    string
+	subtype string
+}
+
+// profileCache holds the profile lookups done while processing the
+// metrics of a host, so that every metric path is only looked up once
+// across dropUnconfigured and elasticDocuments. Profiles are looked
+// up by the path the producer sent, relabeled and derived series are
+// mapped back to it.
+type profileCache struct {
+	results map[profileKey]profileResult
+	// producer paths of relabeled and derived series
+	origins map[seriesKey]string
+}
+
+// newProfileCache returns an empty profileCache
+func newProfileCache() *profileCache {
+	return &profileCache{
+		results: make(map[profileKey]profileResult),
+		origins: make(map[seriesKey]string),
+	}
+}
+
+// origin returns the producer path of the series path and subtype
+func (c *profileCache) origin(path, subtype string) string {
+	if o, ok := c.origins[seriesKey{path: path, subtype: subtype}]; ok {
+		return o
+	}
+	return path
+}
+
+// derive records that the series path and subtype was derived from
+// the series from and fromSubtype
+func (c *profileCache) derive(path, subtype, from, fromSubtype string) {
+	if path == from && subtype == fromSubtype {
+		return
+	}
+	c.origins[seriesKey{path: path, subtype: subtype}] = c.origin(from,
+		fromSubtype)
+}
+
+// cachedProfiles returns the profiles of the series path and subtype
+// of hostID from cache, looking them up by its producer path if they
+// are not cached yet
+func (d *DustDevil) cachedProfiles(cache *profileCache, hostID int, path, subtype string) ([]profile, bool) {
+	key := profileKey{hostID: hostID, path: cache.origin(path, subtype)}
+	if res, ok := cache.results[key]; ok {
+		return res.profiles, res.configured
+	}
+	profiles, configured := d.profiles(hostID, key.path)
+	cache.results[key] = profileResult{
+		profiles:   profiles,
+		configured: configured,
+	}
+	return profiles, configured
+}
+
+// profiles returns the eyewall profiles configured for metric path
+// of hostID. Lookup errors are logged and treated as if the metric
+// was configured without profile data.
+func (d *DustDevil) profiles(hostID int, path string) ([]profile, bool) {
+	thresholds, err := d.thresholds.LookupThreshold(
+		wall.CalculateLookupID(uint64(hostID), path))
+	switch err {
+	case nil:
+	case wall.ErrUnconfigured:
+		return nil, false
+	default:
+		logrus.WithFields(logrus.Fields{
+			`handler`: d.Num,
+			`hostID`:  hostID,
+			`path`:    path,
+		}).Warnf("Profile lookup failed: %s", err)
+		metrics.GetOrRegisterMeter(`/enrich/errors.per.second`,
+			*d.Metrics).Mark(1)
+		return nil, true
+	}
+
+	result := make([]profile, 0, len(thresholds))
+	for id, thr := range thresholds {
+		result = append(result, profile{
+			ConfigurationID: id,
+			Oncall:          thr.Oncall,
+			Predicate:       thr.Predicate,
+			Thresholds:      thr.Thresholds,
+		})
+	}
+	return result, true
+}
+
+// unconfigured returns true if the series path and subtype of hostID
+// is to be dropped for lacking an eyewall profile. The lookup is
+// recorded in cache.
+func (d *DustDevil) unconfigured(cache *profileCache, hostID int, path, subtype string) bool {
+	if !d.Settings.DustDevil.EnrichDropUnconfigured {
+		return false
+	}
+	if _, ok := d.cachedProfiles(cache, hostID, path,
+		subtype); ok {
+		return false
+	}
+	metrics.GetOrRegisterCounter(`/enrich/unconfigured.dropped`,
+		*d.Metrics).Inc(1)
+	return true
+}
+
+// dropUnconfigured removes all metrics from batch that have no eyewall
+// profile, if configured. The lookups are recorded in cache.
+func (d *DustDevil) dropUnconfigured(batch *legacy.MetricBatch, cache *profileCache) {
+	if !d.Settings.DustDevil.EnrichDropUnconfigured {
+		return
+	}
+
+	for i := range batch.Data {
+		data := batch.Data[i]
+
+		floats := make([]legacy.FloatMetric, 0, len(data.FloatMetrics))
+		for _, m := range data.FloatMetrics {
+			if !d.unconfigured(cache, batch.HostID, m.Metric,
+				m.Subtype) {
+				floats = append(floats, m)
+			}
+		}
+		data.FloatMetrics = floats
+
+		ints := make([]legacy.IntMetric, 0, len(data.IntMetrics))
+		for _, m := range data.IntMetrics {
+			if !d.unconfigured(cache, batch.HostID, m.Metric,
+				m.Subtype) {
+				ints = append(ints, m)
+			}
+		}
+		data.IntMetrics = ints
+
+		strs := make([]legacy.StringMetric, 0, len(data.StringMetrics))
+		for _, m := range data.StringMetrics {
+			if !d.unconfigured(cache, batch.HostID, m.Metric,
+				m.Subtype) {
+				strs = append(strs, m)
+			}
+		}
+		data.StringMetrics = strs
+
+		batch.Data[i] = data
+	}
+}
+
+// elasticDocuments converts batch into marshalled Elasticsearch
+// documents. With enrichment enabled, the eyewall profiles of each
+// metric are attached to its documents as profiles, lookups already
+// done are taken from cache.
+func (d *DustDevil) elasticDocuments(batch *legacy.MetricBatch, cache *profileCache) ([][]byte, error) {
+	docs := [][]byte{}
+
+	if !d.Settings.DustDevil.Enrich {
+		for _, esm := range legacy.ElasticFromBatch(batch) {
+			outMsg, err := json.Marshal(&esm)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, outMsg)
+		}
+		return docs, nil
+	}
+
+	// convert every metric on its own to know which documents belong
+	// to which metric path
+	single := func(data legacy.MetricData, path, subtype string) error {
+		profiles, _ := d.cachedProfiles(cache, batch.HostID, path,
+			subtype)
+		for _, esm := range legacy.ElasticFromBatch(&legacy.MetricBatch{
+			HostID:   batch.HostID,
+			Protocol: batch.Protocol,
+			Data:     []legacy.MetricData{data},
+		}) {
+			outMsg, err := json.Marshal(&enrichedDocument{
+				elasticFields: elasticFields(esm),
+				Profiles:      profiles,
+			})
+			if err != nil {
+				return err
+			}
+			docs = append(docs, outMsg)
+		}
+		return nil
+	}
+
+	for _, data := range batch.Data {
+		for _, m := range data.FloatMetrics {
+			if err := single(legacy.MetricData{
+				Time:          data.Time,
+				FloatMetrics:  []legacy.FloatMetric{m},
+				IntMetrics:    []legacy.IntMetric{},
+				StringMetrics: []legacy.StringMetric{},
+			}, m.Metric, m.Subtype); err != nil {
+				return nil, err
+			}
+		}
+		for _, m := range data.IntMetrics {
+			if err := single(legacy.MetricData{
+				Time:          data.Time,
+				FloatMetrics:  []legacy.FloatMetric{},
+				IntMetrics:    []legacy.IntMetric{m},
+				StringMetrics: []legacy.StringMetric{},
+			}, m.Metric, m.Subtype); err != nil {
+				return nil, err
+			}
+		}
+		for _, m := range data.StringMetrics {
+			if err := single(legacy.MetricData{
+				Time:          data.Time,
+				FloatMetrics:  []legacy.FloatMetric{},
+				IntMetrics:    []legacy.IntMetric{},
+				StringMetrics: []legacy.StringMetric{m},
+			}, m.Metric, m.Subtype); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return docs, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
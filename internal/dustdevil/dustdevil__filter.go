@@ -0,0 +1,91 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// keep evaluates the filter rules for a metric and returns false if
+// the metric is to be dropped
+func (d *DustDevil) keep(hostID int, path, subtype string, types ...string) bool {
+	for _, f := range d.Settings.filters {
+		if !f.match(hostID, path, subtype, types...) {
+			continue
+		}
+		if f.exclude {
+			metrics.GetOrRegisterCounter(
+				fmt.Sprintf("/filter/%s/dropped", f.name),
+				*d.Metrics).Inc(1)
+			return false
+		}
+		return true
+	}
+	return true
+}
+
+// filterBatch removes all metrics from batch that are excluded by
+// the filter rules
+func (d *DustDevil) filterBatch(batch *legacy.MetricBatch) {
+	if len(d.Settings.filters) == 0 {
+		return
+	}
+
+	for i := range batch.Data {
+		data := batch.Data[i]
+
+		floats := make([]legacy.FloatMetric, 0, len(data.FloatMetrics))
+		for _, m := range data.FloatMetrics {
+			if d.keep(batch.HostID, m.Metric, m.Subtype, `real`) {
+				floats = append(floats, m)
+			}
+		}
+		data.FloatMetrics = floats
+
+		ints := make([]legacy.IntMetric, 0, len(data.IntMetrics))
+		for _, m := range data.IntMetrics {
+			if d.keep(batch.HostID, m.Metric, m.Subtype,
+				`integer`, `long`) {
+				ints = append(ints, m)
+			}
+		}
+		data.IntMetrics = ints
+
+		strs := make([]legacy.StringMetric, 0, len(data.StringMetrics))
+		for _, m := range data.StringMetrics {
+			if d.keep(batch.HostID, m.Metric, m.Subtype, `string`) {
+				strs = append(strs, m)
+			}
+		}
+		data.StringMetrics = strs
+
+		batch.Data[i] = data
+	}
+}
+
+// filterSplit removes all tags from split whose metric is excluded by
+// the filter rules
+func (d *DustDevil) filterSplit(split *legacy.MetricSplit) {
+	if len(d.Settings.filters) == 0 {
+		return
+	}
+
+	tags := make([]string, 0, len(split.Tags))
+	for _, tag := range split.Tags {
+		if d.keep(split.HostID, split.Path, tag, split.Type) {
+			tags = append(tags, tag)
+		}
+	}
+	split.Tags = tags
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,34 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+
+	"github.com/mjolnir42/erebos"
+)
+
+// heartbeat records the heartbeat msg and reports it to the eyewall
+// lookup
+func (d *DustDevil) heartbeat(msg *erebos.Transport) {
+	d.Health.beat(d.Num)
+	d.delay.Go(func() {
+		d.lookup.Heartbeat(func() string {
+			switch d.Config.Misc.InstanceName {
+			case ``:
+				return `dustdevil`
+			default:
+				return fmt.Sprintf("dustdevil/%s",
+					d.Config.Misc.InstanceName)
+			}
+		}(), d.Num, msg.Value)
+	})
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,125 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/legacy"
+)
+
+// TestProcessMatrix sends a heartbeat and a metric payload through
+// process for every input format and sink
+func TestProcessMatrix(t *testing.T) {
+	ts := time.Now().UTC().Truncate(time.Second)
+	batch := &legacy.MetricBatch{
+		HostID:   42,
+		Protocol: 1,
+		Data: []legacy.MetricData{{
+			Time: ts,
+			FloatMetrics: []legacy.FloatMetric{{
+				Metric: `/sys/cpu/usage`,
+				Value:  12.5,
+			}},
+			IntMetrics: []legacy.IntMetric{{
+				Metric: `/sys/memory/free`,
+				Value:  1024,
+			}},
+			StringMetrics: []legacy.StringMetric{},
+		}},
+	}
+	splits := []legacy.MetricSplit{{
+		HostID: 42,
+		TS:     ts,
+		Path:   `/sys/cpu/usage`,
+		Type:   `real`,
+		Val:    legacy.MetricValue{FlpVal: 12.5},
+	}, {
+		HostID: 42,
+		TS:     ts,
+		Path:   `/sys/memory/free`,
+		Type:   `integer`,
+		Val:    legacy.MetricValue{IntVal: 1024},
+	}}
+
+	tests := []struct {
+		format  string
+		elastic bool
+		// POST requests for the two metrics
+		posts int
+	}{
+		{format: `batch`, elastic: false, posts: 1},
+		{format: `batch`, elastic: true, posts: 2},
+		{format: `split`, elastic: false, posts: 1},
+		{format: `split`, elastic: true, posts: 2},
+	}
+
+	for _, tc := range tests {
+		name := tc.format
+		if tc.elastic {
+			name += `/elastic`
+		}
+		t.Run(name, func(t *testing.T) {
+			sink := newTestSink(t, http.StatusOK)
+			d := newTestHandler(t, tc.format, tc.elastic, sink.URL, ``)
+
+			// heartbeats are handled before the format dispatch
+			d.process(erebos.NewHeartbeat())
+			d.delay.Wait()
+			noDeath(t, d)
+			if beat, _ := d.Health.activity(d.Num); beat.IsZero() {
+				t.Error(`Heartbeat was not recorded`)
+			}
+			if n := len(sink.posts()); n != 0 {
+				t.Fatalf("Heartbeat caused %d POST requests", n)
+			}
+
+			msgs := []*erebos.Transport{}
+			switch tc.format {
+			case `batch`:
+				msgs = append(msgs, testMessage(t, 42, 1, batch))
+			case `split`:
+				for i := range splits {
+					msgs = append(msgs, testMessage(t, 42,
+						int64(i+1), &splits[i]))
+				}
+			}
+			for _, msg := range msgs {
+				d.process(msg)
+			}
+			if tc.format == `split` {
+				d.assemblyLock.Lock()
+				d.release()
+				d.assemblyLock.Unlock()
+			}
+			d.delay.Wait()
+			noDeath(t, d)
+
+			posts := sink.posts()
+			if len(posts) != tc.posts {
+				t.Fatalf("Received %d POST requests, expected %d",
+					len(posts), tc.posts)
+			}
+			for _, body := range posts {
+				if !json.Valid(body) {
+					t.Errorf("POST body is not JSON: %s", body)
+				}
+			}
+			if n := committed(msgs...); n != len(msgs) {
+				t.Errorf("Committed %d of %d messages", n, len(msgs))
+			}
+		})
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,71 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// trackProcessed updates the offset gauges of the partition of msg
+// after it was received by the handler
+func (d *DustDevil) trackProcessed(msg *erebos.Transport) {
+	if erebos.IsHeartbeat(msg) {
+		return
+	}
+	key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+	d.updateOffsets(key, offsets.process(key, msg.Offset))
+}
+
+// trackCommitted updates the offset gauges of the partition of msg
+// after it was committed
+func (d *DustDevil) trackCommitted(msg *erebos.Transport) {
+	key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+	d.updateOffsets(key, offsets.commit(key, msg.Offset))
+}
+
+// updateOffsets sets the offset gauges of partition key.
+// erebos.Transport does not carry the high watermark of the
+// partition, the lag is reported as the number of consumed but not
+// yet committed messages.
+func (d *DustDevil) updateOffsets(key partitionKey, o partitionOffsets) {
+	pfx := fmt.Sprintf("/kafka/%s/%d", key.topic, key.partition)
+	metrics.GetOrRegisterGauge(pfx+`/offset.processed`,
+		*d.Metrics).Update(o.processed)
+	metrics.GetOrRegisterGauge(pfx+`/offset.committed`,
+		*d.Metrics).Update(o.committed)
+	metrics.GetOrRegisterGauge(pfx+`/commit.lag`,
+		*d.Metrics).Update(o.lag)
+}
+
+// observeDelay records the end-to-end delay in milliseconds between
+// the timestamp of a forwarded MetricData and now
+func (d *DustDevil) observeDelay(ts ...time.Time) {
+	h := metrics.GetOrRegisterHistogram(`/latency/end.to.end.ms`,
+		*d.Metrics, metrics.NewExpDecaySample(1028, 0.015))
+	now := time.Now()
+	for _, t := range ts {
+		h.Update(int64(now.Sub(t) / time.Millisecond))
+	}
+}
+
+// batchTimes returns the timestamps of all MetricData of batch
+func batchTimes(batch legacy.MetricBatch) []time.Time {
+	ts := make([]time.Time, 0, len(batch.Data))
+	for _, data := range batch.Data {
+		ts = append(ts, data.Time)
+	}
+	return ts
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,197 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-resty/resty"
+	metrics "github.com/rcrowley/go-metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// request is a POST request to the statistics API
+type request struct {
+	// trace context of the request, nil is a background context
+	ctx context.Context
+	// hostID the request body belongs to, used for balancing
+	hostID int
+	// endpoint URL, if empty the request is sent to the endpoint
+	// pool
+	endpoint string
+	// name of the route the endpoint belongs to
+	route string
+	body  []byte
+	// non-empty contentType overrides the default Content-Type
+	// header of the client
+	contentType string
+}
+
+// post sends req via HTTP POST. The body is compressed if output
+// compression is enabled and the body is large enough. Requests to
+// the endpoint pool fail over to the next endpoint on errors, routed
+// requests are retried against their endpoint.
+func (d *DustDevil) post(req *request) (*resty.Response, error) {
+	var (
+		encoding string
+		err      error
+		resp     *resty.Response
+	)
+
+	body := req.body
+	if d.Settings.DustDevil.OutputCompression != `none` &&
+		len(body) >= d.Settings.DustDevil.OutputCompressionMinSize {
+		encoding = d.Settings.DustDevil.OutputCompression
+		if body, err = d.compress(body, encoding,
+			d.Settings.DustDevil.OutputCompressionLevel); err != nil {
+			return nil, err
+		}
+	}
+
+	attempts := d.Config.DustDevil.RetryCount + 1
+	tried := make(map[*endpoint]bool)
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			metrics.GetOrRegisterCounter(`/output/retries`,
+				*d.Metrics).Inc(1)
+			time.Sleep(d.backoff(i))
+		}
+
+		// routed requests are retried against their endpoint
+		if req.endpoint != `` {
+			resp, err = d.send(req.ctx, req.endpoint,
+				`route/`+req.route, body, req.contentType, encoding)
+			if err == nil && resp.StatusCode() < 500 {
+				return resp, nil
+			}
+			if err != nil {
+				err = d.attemptFailed(err, req, req.endpoint, i)
+			}
+			continue
+		}
+
+		if len(tried) == d.Pool.Len() {
+			tried = make(map[*endpoint]bool)
+		}
+
+		e := d.Pool.pick(req.hostID, tried)
+		tried[e] = true
+
+		atomic.AddInt32(&e.inflight, 1)
+		resp, err = d.send(req.ctx, e.url,
+			fmt.Sprintf("pool/%d", e.num), body, req.contentType,
+			encoding)
+		atomic.AddInt32(&e.inflight, -1)
+
+		if err == nil && resp.StatusCode() < 500 {
+			d.Pool.success(e)
+			return resp, nil
+		}
+		d.Pool.failure(e)
+		if err != nil {
+			err = d.attemptFailed(err, req, e.url, i)
+		}
+	}
+	return resp, err
+}
+
+// attemptFailed logs the failed attempt n of req to url and returns
+// err with the request context
+func (d *DustDevil) attemptFailed(err error, req *request, url string, n int) error {
+	err = withFields(err, logrus.Fields{
+		`hostID`:   req.hostID,
+		`endpoint`: url,
+		`attempt`:  n + 1,
+	})
+	logrus.WithFields(ErrorFields(err)).Warnf("POST failed: %s", err)
+	return err
+}
+
+// send issues a single HTTP POST request to url. The request is
+// traced as child of ctx and carries the trace context as W3C
+// traceparent header. Its latency is recorded for sink, which names
+// the configured endpoint.
+func (d *DustDevil) send(ctx context.Context, url, sink string, body []byte, contentType, encoding string) (*resty.Response, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := tracer.Start(ctx, `POST`,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String(`endpoint`, url)))
+	defer span.End()
+
+	// acquire resource limit before issuing the POST request
+	d.Limit.Start()
+	atomic.AddInt64(&limitOccupancy, 1)
+	atomic.AddInt64(&d.inflight, 1)
+
+	// timeout must be reset before every request
+	r := d.client.SetTimeout(
+		time.Duration(d.Config.DustDevil.RequestTimeout) *
+			time.Millisecond).
+		R()
+	if contentType != `` {
+		r = r.SetHeader(`Content-Type`, contentType)
+	}
+	if encoding != `` {
+		r = r.SetHeader(`Content-Encoding`, encoding)
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	for k, v := range carrier {
+		r = r.SetHeader(k, v)
+	}
+
+	// make HTTP POST request
+	start := time.Now()
+	resp, err := r.SetBody(body).
+		Post(url)
+	d.observe(sink, resp, err, time.Since(start))
+	switch {
+	case err != nil:
+		span.SetStatus(codes.Error, err.Error())
+	default:
+		span.SetAttributes(attribute.Int(`status`, resp.StatusCode()))
+		if resp.StatusCode() > 299 {
+			span.SetStatus(codes.Error, resp.Status())
+		}
+	}
+
+	// release resource limit
+	atomic.AddInt64(&limitOccupancy, -1)
+	atomic.AddInt64(&d.inflight, -1)
+	d.Limit.Done()
+
+	return resp, err
+}
+
+// backoff returns the wait time before retry n
+func (d *DustDevil) backoff(n int) time.Duration {
+	wait := time.Duration(d.Config.DustDevil.RetryMinWaitTime) *
+		time.Millisecond
+	max := time.Duration(d.Config.DustDevil.RetryMaxWaitTime) *
+		time.Millisecond
+	for i := 1; i < n && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
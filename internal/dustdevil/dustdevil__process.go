@@ -9,102 +9,62 @@
 package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
 
 import (
-	"encoding/json"
-	"fmt"
-	"time"
-
 	"github.com/Sirupsen/logrus"
 	"github.com/mjolnir42/erebos"
-	metrics "github.com/rcrowley/go-metrics"
 	"github.com/solnx/legacy"
 )
 
 // processBatch is the handler for posting a MetricBatch
 func (d *DustDevil) processBatch(msg *erebos.Transport) {
 	if msg == nil || msg.Value == nil {
-		logrus.Warnf("Ignoring empty message from: %d", msg.HostID)
+		logrus.WithFields(d.msgFields(msg)).Warnln(
+			`Ignoring empty message`)
 		if msg != nil {
 			d.commit(msg)
 		}
 		return
 	}
 
-	// handle heartbeat messages
-	if erebos.IsHeartbeat(msg) {
-		d.delay.Go(func() {
-			d.lookup.Heartbeat(func() string {
-				switch d.Config.Misc.InstanceName {
-				case ``:
-					return `dustdevil`
-				default:
-					return fmt.Sprintf("dustdevil/%s",
-						d.Config.Misc.InstanceName)
-				}
-			}(), d.Num, msg.Value)
-		})
-		return
-	}
-
 	// unmarshal message
 	var err error
-	batch := legacy.MetricBatch{}
-	if err = json.Unmarshal(msg.Value, &batch); err != nil {
+	var batch legacy.MetricBatch
+	if batch, err = d.decodeBatch(msg); err != nil {
 		// signal main to shut down
-		d.Death <- err
+		d.Death <- d.fail(err, msg)
 		<-d.Shutdown
 		return
 	}
-
-	// remove string metrics from the batch
-	if d.Config.DustDevil.StripStringMetrics {
-		for i := range batch.Data {
-			data := batch.Data[i]
-			data.StringMetrics = []legacy.StringMetric{}
-			batch.Data[i] = data
-		}
-	}
-
-	var outMsg []byte
-	if outMsg, err = batch.MarshalJSON(); err != nil {
+	// run the processing pipeline
+	profiles := newProfileCache()
+	if err = d.transformBatch(&batch, msg, profiles); err != nil {
 		// signal main to shut down
-		d.Death <- err
+		d.Death <- d.fail(err, msg)
 		<-d.Shutdown
 		return
 	}
 
-	// acquire resource limit before issuing the POST request
-	d.Limit.Start()
-
-	// timeout must be reset before every request
-	r := d.client.SetTimeout(
-		time.Duration(d.Config.DustDevil.RequestTimeout) *
-			time.Millisecond).
-		R()
-
-	// make HTTP POST request
-	resp, err := r.SetBody(outMsg).
-		Post(d.Config.DustDevil.Endpoint)
-
-	// release resource limit
-	d.Limit.Done()
+	// collect the batch into downsampling windows
+	if d.downsample != nil {
+		d.downsampleBatch(batch, msg.Topic,
+			[]*erebos.Transport{msg}, profiles)
+		return
+	}
 
-	// check HTTP response
-	if err != nil {
-		// signal main to shut down
-		d.Death <- err
-		<-d.Shutdown
+	// collect the batch into aggregated requests
+	if d.Settings.DustDevil.Aggregate {
+		d.aggregateBatch(batch, msg)
 		return
 	}
-	if resp.StatusCode() > 299 {
+
+	// make HTTP POST requests
+	if err = d.deliver(traceContext(msg), batch, msg.Topic,
+		profiles); err != nil {
 		// signal main to shut down
-		d.Death <- fmt.Errorf("HTTP response was: %s", resp.Status())
+		d.Death <- d.fail(err, msg)
 		<-d.Shutdown
 		return
 	}
 
-	metrics.GetOrRegisterMeter(`/output/messages.per.second`,
-		*d.Metrics).Mark(1)
-
 	d.delay.Go(func() {
 		d.commit(msg)
 	})
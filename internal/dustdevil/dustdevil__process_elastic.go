@@ -9,12 +9,7 @@
 package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
 
 import (
-	"encoding/json"
-	"fmt"
-	"time"
-
 	"github.com/mjolnir42/erebos"
-	metrics "github.com/rcrowley/go-metrics"
 	"github.com/solnx/legacy"
 )
 
@@ -22,63 +17,37 @@ import (
 // Elasticsearch
 func (d *DustDevil) processBatchElastic(msg *erebos.Transport) {
 	var err error
-	out := metrics.GetOrRegisterMeter(`/output/messages.per.second`, *d.Metrics)
 
 	// unmarshal message
-	batch := legacy.MetricBatch{}
-	if err = json.Unmarshal(msg.Value, &batch); err != nil {
-		d.Death <- err
+	var batch legacy.MetricBatch
+	if batch, err = d.decodeBatch(msg); err != nil {
+		d.Death <- d.fail(err, msg)
+		<-d.Shutdown
+		return
+	}
+	// run the processing pipeline
+	profiles := newProfileCache()
+	if err = d.transformBatch(&batch, msg, profiles); err != nil {
+		// signal main to shut down
+		d.Death <- d.fail(err, msg)
 		<-d.Shutdown
 		return
 	}
 
-	// convert to []MetricElastic
-	esMetrics := legacy.ElasticFromBatch(&batch)
-
-	// forward all created MetricElastic to elasticsearch
-	for _, esm := range esMetrics {
-		var outMsg []byte
-		if outMsg, err = json.Marshal(&esm); err != nil {
-			// signal main to shut down
-			d.Death <- err
-			<-d.Shutdown
-			return
-		}
-		// acquire resource limit before issuing the POST request
-		d.Limit.Start()
-
-		// timeout must be reset before every request
-		r := d.client.SetTimeout(
-			time.Duration(d.Config.DustDevil.RequestTimeout) *
-				time.Millisecond).
-			R()
-
-		// make HTTP POST request
-		resp, err := r.SetBody(outMsg).
-			Post(d.Config.DustDevil.Endpoint)
-
-		// release resource limit
-		d.Limit.Done()
-
-		// check HTTP response error
-		if err != nil {
-			// signal main to shut down
-			d.Death <- err
-			<-d.Shutdown
-			return
-		}
-
-		// check HTTP response statuscode
-		if resp.StatusCode() > 299 {
-			// signal main to shut down
-			d.Death <- fmt.Errorf("ES HTTP response was: %s",
-				resp.Status())
-			<-d.Shutdown
-			return
-		}
+	// collect the batch into downsampling windows
+	if d.downsample != nil {
+		d.downsampleBatch(batch, msg.Topic,
+			[]*erebos.Transport{msg}, profiles)
+		return
+	}
 
-		// mark successful outgoing message
-		out.Mark(1)
+	// forward to elasticsearch
+	if err = d.deliver(traceContext(msg), batch, msg.Topic,
+		profiles); err != nil {
+		// signal main to shut down
+		d.Death <- d.fail(err, msg)
+		<-d.Shutdown
+		return
 	}
 
 	// commit msg offset as processed
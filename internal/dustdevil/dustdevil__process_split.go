@@ -9,13 +9,11 @@
 package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"sync"
-	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/mjolnir42/erebos"
-	metrics "github.com/rcrowley/go-metrics"
 	"github.com/solnx/legacy"
 )
 
@@ -28,22 +26,27 @@ type postResult struct {
 // release triggers the reassembly of cached metrics and forwarding
 // the result
 func (d *DustDevil) release() {
-	resC := make(chan *postResult)
+	if d.downsample != nil {
+		d.releaseDownsampled()
+		return
+	}
+
+	if d.Settings.DustDevil.Aggregate &&
+		!d.Config.DustDevil.ForwardElastic {
+		d.releaseAggregated()
+		return
+	}
+
+	// every assemblePost sends one result, which are only read after
+	// all of them finished
+	resC := make(chan *postResult, len(d.assembly))
 	wg := sync.WaitGroup{}
 	for hostID := range d.assembly {
 		wg.Add(1)
-		switch d.Config.DustDevil.ForwardElastic {
-		case true:
-			go func(ID int) {
-				d.assemblePostElastic(ID, resC)
-				wg.Done()
-			}(hostID)
-		default:
-			go func(ID int) {
-				d.assemblePost(ID, resC)
-				wg.Done()
-			}(hostID)
-		}
+		go func(ID int) {
+			d.assemblePost(ID, resC)
+			wg.Done()
+		}(hostID)
 	}
 	// wait for all assemblePost
 	wg.Wait()
@@ -57,7 +60,9 @@ resLoop:
 		if res.err != nil {
 			if !shutdown {
 				// only send first error to main
-				d.Death <- res.err
+				d.Death <- d.fail(withFields(res.err, logrus.Fields{
+					`hostID`: res.hostID,
+				}), nil)
 				shutdown = true
 			}
 			continue resLoop
@@ -65,6 +70,7 @@ resLoop:
 
 		// clear message store for hostID
 		delete(d.assembly, res.hostID)
+		delete(d.assemblyProfiles, res.hostID)
 
 		// ACK d.assemblyCommit for hostID
 		for i := range d.assemblyCommit[res.hostID] {
@@ -83,83 +89,43 @@ resLoop:
 	}
 }
 
-// assemblePost constructs legacy.MetricBatch for hostID and
-// forwards it via http.Post
-func (d *DustDevil) assemblePost(hostID int, resC chan *postResult) {
-	var err error
-	if len(d.assembly[hostID]) == 0 {
-		resC <- &postResult{
-			hostID: hostID,
-			err:    nil,
-		}
-		return
-	}
-
+// assembledBatch returns the legacy.MetricBatch assembled for hostID,
+// after passing it through the transformation script
+func (d *DustDevil) assembledBatch(hostID int) legacy.MetricBatch {
 	batch := legacy.MetricBatch{
 		HostID:   hostID,
 		Protocol: 1,
 	}
-	batch.Data = make([]legacy.MetricData, 0)
+	batch.Data = make([]legacy.MetricData, 0, len(d.assembly[hostID]))
 	for ts := range d.assembly[hostID] {
 		batch.Data = append(batch.Data, d.assembly[hostID][ts])
 	}
+	d.scriptBatch(&batch, nil)
+	return batch
+}
 
-	var outMsg []byte
-	if outMsg, err = batch.MarshalJSON(); err != nil {
-		resC <- &postResult{
-			hostID: hostID,
-			err:    err,
-		}
-		return
-	}
-
-	// acquire resource limit before issuing the POST request
-	d.Limit.Start()
-
-	// timeout must be reset before every request
-	r := d.client.SetTimeout(
-		time.Duration(d.Config.DustDevil.RequestTimeout) *
-			time.Millisecond).
-		R()
-
-	// make HTTP POST request
-	resp, err := r.SetBody(outMsg).
-		Post(d.Config.DustDevil.Endpoint)
-
-	// release resource limit
-	d.Limit.Done()
-
-	// check HTTP response
-	if err != nil {
-		resC <- &postResult{
-			hostID: hostID,
-			err:    err,
-		}
-		return
-	}
-	if resp.StatusCode() > 299 {
-		// signal main to shut down
-		resC <- &postResult{
-			hostID: hostID,
-			err: fmt.Errorf("HTTP response was: %s",
-				resp.Status()),
-		}
-		return
+// assemblyTopic returns the topic the assembled messages of hostID
+// were consumed from
+func (d *DustDevil) assemblyTopic(hostID int) string {
+	if len(d.assemblyCommit[hostID]) == 0 {
+		return ``
 	}
+	return d.assemblyCommit[hostID][0].Topic
+}
 
-	metrics.GetOrRegisterMeter(`/output/messages.per.second`,
-		*d.Metrics).Mark(1)
-
-	resC <- &postResult{
-		hostID: hostID,
-		err:    nil,
+// assemblyContext returns the trace context of the first assembled
+// message of hostID
+func (d *DustDevil) assemblyContext(hostID int) context.Context {
+	if len(d.assemblyCommit[hostID]) == 0 {
+		return context.Background()
 	}
+	return traceContext(d.assemblyCommit[hostID][0])
 }
 
-// assemblePostElastic constructs legacy.MetricElastic for hostID
-// and sends it via http.Post to ElasticSearch
-func (d *DustDevil) assemblePostElastic(hostID int, resC chan *postResult) {
-	var err error
+// assemblePost constructs legacy.MetricBatch for hostID and
+// forwards it via http.Post, either as MetricBatch or as
+// MetricElastic to ElasticSearch
+func (d *DustDevil) assemblePost(hostID int, resC chan *postResult) {
 	if len(d.assembly[hostID]) == 0 {
 		resC <- &postResult{
 			hostID: hostID,
@@ -168,73 +134,11 @@ func (d *DustDevil) assemblePostElastic(hostID int, resC chan *postResult) {
 		return
 	}
 
-	out := metrics.GetOrRegisterMeter(`/output/messages.per.second`,
-		*d.Metrics)
-
-	batch := legacy.MetricBatch{
-		HostID:   hostID,
-		Protocol: 1,
-	}
-	batch.Data = []legacy.MetricData{}
-	for ts := range d.assembly[hostID] {
-		batch.Data = append(batch.Data, d.assembly[hostID][ts])
-	}
-
-	// convert to []MetricElastic
-	esMetrics := legacy.ElasticFromBatch(&batch)
-
-	// forward all created MetricElastic to elasticsearch
-	for _, esm := range esMetrics {
-		var outMsg []byte
-		if outMsg, err = json.Marshal(&esm); err != nil {
-			resC <- &postResult{
-				hostID: hostID,
-				err:    err,
-			}
-			return
-		}
-		// acquire resource limit before issuing the POST request
-		d.Limit.Start()
-
-		// timeout must be reset before every request
-		r := d.client.SetTimeout(
-			time.Duration(d.Config.DustDevil.RequestTimeout) *
-				time.Millisecond).
-			R()
-
-		// make HTTP POST request
-		resp, lErr := r.SetBody(outMsg).
-			Post(d.Config.DustDevil.Endpoint)
-
-		// release resource limit
-		d.Limit.Done()
-
-		// check HTTP response error
-		if lErr != nil {
-			resC <- &postResult{
-				hostID: hostID,
-				err:    lErr,
-			}
-			return
-		}
-
-		// check HTTP response statuscode
-		if resp.StatusCode() > 299 {
-			// signal main to shut down
-			resC <- &postResult{
-				hostID: hostID,
-				err: fmt.Errorf("ES HTTP response was: %s",
-					resp.Status()),
-			}
-			return
-		}
-
-		// mark successful outgoing message
-		out.Mark(1)
-	}
 	resC <- &postResult{
 		hostID: hostID,
-		err:    nil,
+		err: d.deliver(d.assemblyContext(hostID),
+			d.assembledBatch(hostID), d.assemblyTopic(hostID),
+			d.assemblyProfiles[hostID]),
 	}
 }
 
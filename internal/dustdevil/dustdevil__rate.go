@@ -0,0 +1,87 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"path"
+	"sort"
+	"time"
+
+	"github.com/solnx/legacy"
+)
+
+// isCounter returns true if the metric path is configured to be
+// converted into a rate
+func (d *DustDevil) isCounter(metricPath string) bool {
+	for _, glob := range d.Settings.DustDevil.RateCounterPaths {
+		if ok, _ := path.Match(glob, metricPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// counterRate returns the rate FloatMetric derived from the counter
+// sample, if one can be derived. The counter is recorded in cache as
+// the origin of the rate.
+func (d *DustDevil) counterRate(cache *profileCache, hostID int, ts time.Time, m legacy.IntMetric) (legacy.FloatMetric, bool) {
+	if !d.isCounter(m.Metric) {
+		return legacy.FloatMetric{}, false
+	}
+
+	rate, ok := d.rates.rate(counterKey{
+		hostID:  hostID,
+		path:    m.Metric,
+		subtype: m.Subtype,
+	}, ts, m.Value)
+	if !ok {
+		return legacy.FloatMetric{}, false
+	}
+	path := m.Metric + d.Settings.DustDevil.RateSuffix
+	cache.derive(path, m.Subtype, m.Metric, m.Subtype)
+	return legacy.FloatMetric{
+		Metric:  path,
+		Subtype: m.Subtype,
+		Value:   rate,
+	}, true
+}
+
+// rateBatch adds the rates of all counters in batch. The counters
+// themselves are removed unless configured otherwise. The counters
+// are recorded in cache as the origin of their rates.
+func (d *DustDevil) rateBatch(batch *legacy.MetricBatch, cache *profileCache) {
+	if len(d.Settings.DustDevil.RateCounterPaths) == 0 {
+		return
+	}
+
+	// rates are derived from consecutive samples
+	sort.Slice(batch.Data, func(i, j int) bool {
+		return batch.Data[i].Time.Before(batch.Data[j].Time)
+	})
+
+	for i := range batch.Data {
+		data := batch.Data[i]
+		ints := make([]legacy.IntMetric, 0, len(data.IntMetrics))
+		for _, m := range data.IntMetrics {
+			rate, ok := d.counterRate(cache, batch.HostID,
+				data.Time, m)
+			if ok {
+				data.FloatMetrics = append(data.FloatMetrics, rate)
+			}
+			if d.Settings.DustDevil.RateKeepCounters ||
+				!d.isCounter(m.Metric) {
+				ints = append(ints, m)
+			}
+		}
+		data.IntMetrics = ints
+		batch.Data[i] = data
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,60 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"github.com/solnx/legacy"
+)
+
+// relabel applies all relabel rules to a metric path and subtype
+func (d *DustDevil) relabel(path, subtype string) (string, string) {
+	for _, r := range d.Settings.relabels {
+		path, subtype = r.apply(path, subtype,
+			d.Config.Misc.InstanceName)
+	}
+	return path, subtype
+}
+
+// relabelSeries applies all relabel rules to a metric path and
+// subtype and records the original series in cache
+func (d *DustDevil) relabelSeries(cache *profileCache, path, subtype string) (string, string) {
+	newPath, newSubtype := d.relabel(path, subtype)
+	cache.derive(newPath, newSubtype, path, subtype)
+	return newPath, newSubtype
+}
+
+// relabelBatch applies all relabel rules to the metrics in batch. The
+// original series are recorded in cache.
+func (d *DustDevil) relabelBatch(batch *legacy.MetricBatch, cache *profileCache) {
+	if len(d.Settings.relabels) == 0 {
+		return
+	}
+
+	for i := range batch.Data {
+		data := batch.Data[i]
+		for j := range data.FloatMetrics {
+			data.FloatMetrics[j].Metric, data.FloatMetrics[j].Subtype =
+				d.relabelSeries(cache, data.FloatMetrics[j].Metric,
+					data.FloatMetrics[j].Subtype)
+		}
+		for j := range data.IntMetrics {
+			data.IntMetrics[j].Metric, data.IntMetrics[j].Subtype =
+				d.relabelSeries(cache, data.IntMetrics[j].Metric,
+					data.IntMetrics[j].Subtype)
+		}
+		for j := range data.StringMetrics {
+			data.StringMetrics[j].Metric, data.StringMetrics[j].Subtype =
+				d.relabelSeries(cache, data.StringMetrics[j].Metric,
+					data.StringMetrics[j].Subtype)
+		}
+		batch.Data[i] = data
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
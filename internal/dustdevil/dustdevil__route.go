@@ -0,0 +1,131 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// routedBatch is the part of a MetricBatch that is forwarded to one
+// endpoint
+type routedBatch struct {
+	route    string
+	endpoint string
+	batch    legacy.MetricBatch
+}
+
+// route splits batch into the parts forwarded to each route's
+// endpoint. Metrics not matched by any route are forwarded to the
+// endpoint pool, which is selected by an empty endpoint.
+func (d *DustDevil) route(batch legacy.MetricBatch, topic string) ([]routedBatch, error) {
+	routes := make([]*route, 0, len(d.Settings.routes))
+	for _, r := range d.Settings.routes {
+		if r.matchHost(batch.HostID, topic) {
+			routes = append(routes, r)
+		}
+	}
+
+	// fast path, everything is forwarded to the endpoint pool
+	if len(routes) == 0 {
+		return []routedBatch{{
+			route:    `default`,
+			endpoint: ``,
+			batch:    batch,
+		}}, nil
+	}
+
+	// index len(routes) is the default route
+	parts := make([]legacy.MetricBatch, len(routes)+1)
+	for i := range parts {
+		parts[i] = legacy.MetricBatch{
+			HostID:   batch.HostID,
+			Protocol: batch.Protocol,
+			Data:     make([]legacy.MetricData, 0),
+		}
+	}
+
+	match := func(path string) int {
+		for i, r := range routes {
+			if r.matchPath(path) {
+				return i
+			}
+		}
+		return len(routes)
+	}
+
+	for _, data := range batch.Data {
+		split := make([]legacy.MetricData, len(parts))
+		for i := range split {
+			split[i] = legacy.MetricData{
+				Time:          data.Time,
+				FloatMetrics:  make([]legacy.FloatMetric, 0),
+				StringMetrics: make([]legacy.StringMetric, 0),
+				IntMetrics:    make([]legacy.IntMetric, 0),
+			}
+		}
+		for _, m := range data.FloatMetrics {
+			i := match(m.Metric)
+			split[i].FloatMetrics = append(split[i].FloatMetrics, m)
+		}
+		for _, m := range data.StringMetrics {
+			i := match(m.Metric)
+			split[i].StringMetrics = append(split[i].StringMetrics, m)
+		}
+		for _, m := range data.IntMetrics {
+			i := match(m.Metric)
+			split[i].IntMetrics = append(split[i].IntMetrics, m)
+		}
+		for i := range split {
+			if len(split[i].FloatMetrics)+len(split[i].StringMetrics)+
+				len(split[i].IntMetrics) == 0 {
+				continue
+			}
+			parts[i].Data = append(parts[i].Data, split[i])
+		}
+	}
+
+	result := make([]routedBatch, 0, len(parts))
+	for i := range parts {
+		if len(parts[i].Data) == 0 {
+			continue
+		}
+		if i == len(routes) {
+			result = append(result, routedBatch{
+				route:    `default`,
+				endpoint: ``,
+				batch:    parts[i],
+			})
+			continue
+		}
+		endpoint, err := routes[i].url(batch.HostID,
+			d.Config.Misc.InstanceName)
+		if err != nil {
+			return nil, fmt.Errorf("Route %s: %s", routes[i].name,
+				err)
+		}
+		result = append(result, routedBatch{
+			route:    routes[i].name,
+			endpoint: endpoint,
+			batch:    parts[i],
+		})
+	}
+	return result, nil
+}
+
+// markRoute marks a successful request for the named route
+func (d *DustDevil) markRoute(name string) {
+	metrics.GetOrRegisterMeter(
+		fmt.Sprintf("/output/route/%s/requests.per.second", name),
+		*d.Metrics).Mark(1)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
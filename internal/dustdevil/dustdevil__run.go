@@ -11,26 +11,87 @@ package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
 import (
 	"time"
 
+	"github.com/mjolnir42/erebos"
 	metrics "github.com/rcrowley/go-metrics"
 )
 
+// releaseInterval is the time between two releases of the assembled
+// MetricSplit
+var releaseInterval = 20 * time.Second
+
 // run is the event loop for DustDevil
 func (d *DustDevil) run() {
 	in := metrics.GetOrRegisterMeter(`/input/messages.per.second`, *d.Metrics)
 
+	// aggregated requests of the batch input format are sent at
+	// least once per configured maximum delay
+	var aggregationTick, rateExpiryTick, downsampleTick <-chan time.Time
+	if d.Settings.DustDevil.Aggregate &&
+		d.Config.DustDevil.InputFormat == `batch` &&
+		!d.Config.DustDevil.ForwardElastic {
+		aggregationTick = time.Tick(time.Duration(
+			d.Settings.DustDevil.AggregateMaxDelay) * time.Millisecond)
+	}
+
+	// counter state of quiet hosts is expired
+	if len(d.Settings.DustDevil.RateCounterPaths) > 0 {
+		rateExpiryTick = time.Tick(time.Minute)
+	}
+
+	// buckets of quiet hosts are expired, only the first handler
+	// does this for the shared Throttle
+	var throttleExpiryTick <-chan time.Time
+	if d.Throttle != nil && d.Num == 0 {
+		throttleExpiryTick = time.Tick(time.Minute)
+	}
+
+	// gauges are sampled periodically
+	gaugeTick := time.Tick(5 * time.Second)
+
+	// the loop reports that it is running, the liveness check does
+	// not depend on received messages
+	loopTick := time.Tick(time.Second)
+
+	// assembled MetricSplit are released periodically
+	releaseTick := time.Tick(releaseInterval)
+
+	// closed downsampling windows are delivered
+	if d.downsample != nil {
+		downsampleTick = time.Tick(time.Second)
+	}
+
 runloop:
 	for {
 		select {
 		case <-d.Shutdown:
 			// drain input channel which will be closed by main
 			goto drainloop
-		case <-time.Tick(20 * time.Second):
+		case <-releaseTick:
 			switch d.Config.DustDevil.InputFormat {
 			case `split`:
 				d.assemblyLock.Lock()
 				d.release()
 				d.assemblyLock.Unlock()
 			}
+		case <-aggregationTick:
+			d.delay.Go(func() {
+				d.flushAggregation()
+			})
+		case <-downsampleTick:
+			d.delay.Go(func() {
+				d.flushDownsample()
+			})
+		case fn := <-d.controlC:
+			fn()
+		case <-gaugeTick:
+			d.updateGauges()
+		case <-loopTick:
+			d.Health.loop(d.Num)
+		case <-rateExpiryTick:
+			d.rates.expire(time.Duration(
+				d.Settings.DustDevil.RateExpiry) * time.Second)
+		case <-throttleExpiryTick:
+			d.Throttle.expire(time.Hour)
 		case msg := <-d.Input:
 			if msg == nil {
 				// we read the closed input channel, skip to read the
@@ -38,19 +99,10 @@ runloop:
 				continue runloop
 			}
 			in.Mark(1)
+			dequeued(msg)
+			d.trackProcessed(msg)
 			d.delay.Go(func() {
-				switch d.Config.DustDevil.InputFormat {
-				case `batch`:
-					if d.Config.DustDevil.ForwardElastic {
-						d.processBatchElastic(msg)
-						return
-					}
-					d.processBatch(msg)
-				case `split`:
-					d.assemblyLock.Lock()
-					d.assembleSplit(msg)
-					d.assemblyLock.Unlock()
-				}
+				d.process(msg)
 			})
 		}
 	}
@@ -65,15 +117,44 @@ drainloop:
 				break drainloop
 			}
 			in.Mark(1)
-			switch d.Config.DustDevil.InputFormat {
-			case `batch`:
-				d.processBatch(msg)
-			case `split`:
-				d.assembleSplit(msg)
-			}
+			dequeued(msg)
+			d.process(msg)
 		}
 	}
+	// messages still in process must reach the aggregation buffers
+	// and windows before these are flushed
+	d.delay.Wait()
+	if d.Settings.DustDevil.Aggregate {
+		d.flushAggregation()
+	}
+	if d.downsample != nil {
+		d.drainDownsample()
+	}
 	d.delay.Wait()
 }
 
+// process hands msg to the processing function of the configured
+// input format and sink. Heartbeats are handled here for all of
+// them.
+func (d *DustDevil) process(msg *erebos.Transport) {
+	if erebos.IsHeartbeat(msg) {
+		d.heartbeat(msg)
+		return
+	}
+
+	switch d.Config.DustDevil.InputFormat {
+	case `batch`:
+		if d.Config.DustDevil.ForwardElastic {
+			d.processBatchElastic(msg)
+		} else {
+			d.processBatch(msg)
+		}
+	case `split`:
+		d.assemblyLock.Lock()
+		d.assembleSplit(msg)
+		d.assemblyLock.Unlock()
+	}
+	d.Health.process(d.Num)
+}
+
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
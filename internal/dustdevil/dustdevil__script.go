@@ -0,0 +1,56 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// scriptBatch passes batch through the transformation script. If the
+// script drops the batch, all its data is removed. On script errors
+// batch is left unmodified. msg is the message batch was consumed
+// from, nil for assembled batches.
+func (d *DustDevil) scriptBatch(batch *legacy.MetricBatch, msg *erebos.Transport) {
+	if d.Settings.script == nil {
+		return
+	}
+
+	res, ok, err := d.Settings.script.call(*batch)
+	if err != nil {
+		metrics.GetOrRegisterCounter(`/script/errors`,
+			*d.Metrics).Inc(1)
+		fields := d.msgFields(msg)
+		fields[`hostID`] = batch.HostID
+		logrus.WithFields(fields).Warnf("Script error: %s", err)
+		return
+	}
+
+	hostID := batch.HostID
+	before, _ := countMetrics(*batch)
+	if !ok {
+		metrics.GetOrRegisterCounter(`/script/dropped`,
+			*d.Metrics).Inc(1)
+		batch.Data = []legacy.MetricData{}
+	} else {
+		*batch = res
+	}
+
+	// metrics removed by the script are dropped
+	after, _ := countMetrics(*batch)
+	if after < before {
+		metrics.GetOrRegisterCounter(`/script/metrics.dropped`,
+			*d.Metrics).Inc(int64(before - after))
+		d.Stats.dropped(hostID, before-after, 0)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,89 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// limitOccupancy is the number of requests currently holding the
+// shared concurrency limit
+var limitOccupancy int64
+
+// observe records the latency and outcome of a POST request to
+// sink. Sinks are the configured routes and pool endpoints, not the
+// URLs of templated routes, to keep the number of timers bounded.
+func (d *DustDevil) observe(sink string, resp *resty.Response, err error, elapsed time.Duration) {
+	class := `error`
+	if err == nil {
+		class = fmt.Sprintf("%dxx", resp.StatusCode()/100)
+	}
+	metrics.GetOrRegisterTimer(
+		fmt.Sprintf("/output/sink/%s/%s/latency", sink, class),
+		*d.Metrics).Update(elapsed)
+
+	d.Health.posted(err == nil && resp.StatusCode() < 500)
+	if err != nil || resp.StatusCode() > 299 {
+		metrics.GetOrRegisterCounter(`/output/http.errors`,
+			*d.Metrics).Inc(1)
+	}
+}
+
+// deadLetter writes data rejected from msg for reason to the
+// dead-letter file and counts it
+func (d *DustDevil) deadLetter(msg *erebos.Transport, hostID int, reason string, data interface{}) error {
+	if err := d.DeadLetter.write(msg, hostID, reason,
+		data); err != nil {
+		return err
+	}
+	metrics.GetOrRegisterCounter(
+		fmt.Sprintf("/deadletter/%s/written", reason),
+		*d.Metrics).Inc(1)
+	return nil
+}
+
+// updateGauges refreshes the gauges of the handler
+func (d *DustDevil) updateGauges() {
+	metrics.GetOrRegisterGauge(
+		fmt.Sprintf("/handler/%d/queue.depth", d.Num),
+		*d.Metrics).Update(int64(len(d.Input)))
+	metrics.GetOrRegisterGauge(`/limit/occupancy`,
+		*d.Metrics).Update(atomic.LoadInt64(&limitOccupancy))
+	metrics.GetOrRegisterGauge(`/limit/capacity`,
+		*d.Metrics).Update(int64(d.Config.DustDevil.ConcurrencyLimit))
+
+	if d.Config.DustDevil.InputFormat != `split` {
+		return
+	}
+	var hosts, points int64
+	d.assemblyLock.Lock()
+	for hostID := range d.assembly {
+		hosts++
+		for ts := range d.assembly[hostID] {
+			data := d.assembly[hostID][ts]
+			points += int64(len(data.FloatMetrics) +
+				len(data.IntMetrics) + len(data.StringMetrics))
+		}
+	}
+	d.assemblyLock.Unlock()
+	metrics.GetOrRegisterGauge(
+		fmt.Sprintf("/handler/%d/assembly.hosts", d.Num),
+		*d.Metrics).Update(hosts)
+	metrics.GetOrRegisterGauge(
+		fmt.Sprintf("/handler/%d/assembly.metrics", d.Num),
+		*d.Metrics).Update(points)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,135 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// admit applies the sampling rules and the rate limits to n metrics
+// of hostID with path metricPath. It returns whether the metrics are
+// forwarded and whether they were rejected by a rate limit.
+func (d *DustDevil) admit(hostID int, metricPath string, n int) (ok, throttled bool) {
+	if !d.Settings.sampled(metricPath) {
+		metrics.GetOrRegisterMeter(`/sampling/dropped.per.second`,
+			*d.Metrics).Mark(int64(n))
+		return false, false
+	}
+	if d.Throttle == nil {
+		return true, false
+	}
+
+	ok, global := d.Throttle.allow(hostID, n)
+	switch {
+	case ok:
+		return true, false
+	case global:
+		metrics.GetOrRegisterMeter(
+			`/throttle/global/dropped.per.second`,
+			*d.Metrics).Mark(int64(n))
+	default:
+		metrics.GetOrRegisterMeter(
+			`/throttle/host/dropped.per.second`,
+			*d.Metrics).Mark(int64(n))
+	}
+	return false, true
+}
+
+// throttleBatch removes all metrics from batch that are discarded by
+// sampling or exceed the rate limits. An error is only returned if
+// writing to the dead-letter file fails.
+func (d *DustDevil) throttleBatch(batch *legacy.MetricBatch, msg *erebos.Transport) error {
+	if d.Throttle == nil && len(d.Settings.samples) == 0 {
+		return nil
+	}
+
+	rejected := make([]legacy.MetricData, 0)
+	for i := range batch.Data {
+		data := batch.Data[i]
+		reject := legacy.MetricData{
+			Time:          data.Time,
+			FloatMetrics:  make([]legacy.FloatMetric, 0),
+			StringMetrics: make([]legacy.StringMetric, 0),
+			IntMetrics:    make([]legacy.IntMetric, 0),
+		}
+
+		floats := make([]legacy.FloatMetric, 0, len(data.FloatMetrics))
+		for _, m := range data.FloatMetrics {
+			ok, throttled := d.admit(batch.HostID, m.Metric, 1)
+			switch {
+			case ok:
+				floats = append(floats, m)
+			case throttled:
+				reject.FloatMetrics = append(reject.FloatMetrics, m)
+			}
+		}
+		data.FloatMetrics = floats
+
+		ints := make([]legacy.IntMetric, 0, len(data.IntMetrics))
+		for _, m := range data.IntMetrics {
+			ok, throttled := d.admit(batch.HostID, m.Metric, 1)
+			switch {
+			case ok:
+				ints = append(ints, m)
+			case throttled:
+				reject.IntMetrics = append(reject.IntMetrics, m)
+			}
+		}
+		data.IntMetrics = ints
+
+		strs := make([]legacy.StringMetric, 0, len(data.StringMetrics))
+		for _, m := range data.StringMetrics {
+			ok, throttled := d.admit(batch.HostID, m.Metric, 1)
+			switch {
+			case ok:
+				strs = append(strs, m)
+			case throttled:
+				reject.StringMetrics = append(reject.StringMetrics, m)
+			}
+		}
+		data.StringMetrics = strs
+
+		batch.Data[i] = data
+		if len(reject.FloatMetrics)+len(reject.IntMetrics)+
+			len(reject.StringMetrics) > 0 {
+			rejected = append(rejected, reject)
+		}
+	}
+
+	if len(rejected) == 0 ||
+		d.Settings.DustDevil.LimitPolicy != `deadletter` {
+		return nil
+	}
+	return d.deadLetter(msg, batch.HostID, `throttle`, rejected)
+}
+
+// throttleSplit applies sampling and the rate limits to split. It
+// returns false if split is to be discarded. An error is only
+// returned if writing to the dead-letter file fails.
+func (d *DustDevil) throttleSplit(split *legacy.MetricSplit, msg *erebos.Transport) (bool, error) {
+	if d.Throttle == nil && len(d.Settings.samples) == 0 {
+		return true, nil
+	}
+
+	ok, throttled := d.admit(msg.HostID, split.Path, len(split.Tags))
+	if ok {
+		return true, nil
+	}
+	if throttled && d.Settings.DustDevil.LimitPolicy == `deadletter` {
+		if err := d.deadLetter(msg, msg.HostID, `throttle`,
+			split); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
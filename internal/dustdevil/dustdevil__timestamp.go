@@ -0,0 +1,96 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// timestampReference returns the reference time that the timestamps
+// of msg are checked against
+func (d *DustDevil) timestampReference(msg *erebos.Transport) time.Time {
+	// erebos.Transport does not carry the Kafka message timestamp,
+	// the only supported reference is the wall clock
+	return time.Now()
+}
+
+// checkBatchTime applies the timestamp policy to every MetricData
+// of batch that is outside the acceptance window. An error is only
+// returned if writing to the dead-letter file fails.
+func (d *DustDevil) checkBatchTime(batch *legacy.MetricBatch, msg *erebos.Transport) error {
+	if !d.Settings.checksTime() {
+		return nil
+	}
+
+	ref := d.timestampReference(msg)
+	data := make([]legacy.MetricData, 0, len(batch.Data))
+	for _, md := range batch.Data {
+		ts, ok := d.Settings.timeWindow(md.Time, ref)
+		if ok {
+			data = append(data, md)
+			continue
+		}
+		d.markSkew(batch.HostID)
+
+		switch d.Settings.DustDevil.TimestampPolicy {
+		case `clamp`:
+			md.Time = ts
+			data = append(data, md)
+		case `deadletter`:
+			if err := d.deadLetter(msg, batch.HostID,
+				`timestamp`, md); err != nil {
+				return err
+			}
+		}
+	}
+	batch.Data = data
+	return nil
+}
+
+// checkSplitTime applies the timestamp policy to split. It returns
+// false if split is to be discarded. An error is only returned if
+// writing to the dead-letter file fails.
+func (d *DustDevil) checkSplitTime(split *legacy.MetricSplit, msg *erebos.Transport) (bool, error) {
+	if !d.Settings.checksTime() {
+		return true, nil
+	}
+
+	ts, ok := d.Settings.timeWindow(split.TS,
+		d.timestampReference(msg))
+	if ok {
+		return true, nil
+	}
+	d.markSkew(msg.HostID)
+
+	switch d.Settings.DustDevil.TimestampPolicy {
+	case `clamp`:
+		split.TS = ts
+		return true, nil
+	case `deadletter`:
+		if err := d.deadLetter(msg, msg.HostID, `timestamp`,
+			split); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// markSkew counts a timestamp outside the acceptance window for
+// hostID
+func (d *DustDevil) markSkew(hostID int) {
+	metrics.GetOrRegisterCounter(`/timestamp/out.of.range`,
+		*d.Metrics).Inc(1)
+	d.Stats.skewed(hostID)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
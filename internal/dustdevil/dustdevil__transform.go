@@ -0,0 +1,75 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/legacy"
+)
+
+// transformBatch runs batch of msg through the processing pipeline
+// that all input formats share, in this order:
+//
+//	convert, strip, timestamp check, filter, drop unconfigured,
+//	throttle, relabel, rate and script
+//
+// assembleSplit applies the same steps to every MetricSplit, the
+// script is run when the assembled batch is released. The profile
+// lookups and producer paths are recorded in cache. An error is
+// returned if the timestamp check or throttling fail.
+func (d *DustDevil) transformBatch(batch *legacy.MetricBatch, msg *erebos.Transport, cache *profileCache) error {
+	received, ts := countMetrics(*batch)
+	d.Stats.received(msg.HostID, received, ts)
+
+	// convert string metrics with conversion rule, the remaining
+	// ones are subject to stripping
+	d.convertBatch(batch)
+	stripped := d.stripBatch(batch)
+
+	// check the timestamps against the acceptance window
+	if err := d.checkBatchTime(batch, msg); err != nil {
+		return err
+	}
+
+	// apply the filter rules and eyewall profile requirement before
+	// the metrics are counted against the rate limits
+	d.filterBatch(batch)
+	d.dropUnconfigured(batch, cache)
+	if err := d.throttleBatch(batch, msg); err != nil {
+		return err
+	}
+	remaining, _ := countMetrics(*batch)
+	d.Stats.dropped(msg.HostID, received-stripped-remaining, stripped)
+
+	d.relabelBatch(batch, cache)
+
+	// convert counters to rates
+	d.rateBatch(batch, cache)
+
+	// apply the transformation script
+	d.scriptBatch(batch, msg)
+	return nil
+}
+
+// stripBatch removes all string metrics from batch if configured and
+// returns their number
+func (d *DustDevil) stripBatch(batch *legacy.MetricBatch) int {
+	if !d.Config.DustDevil.StripStringMetrics {
+		return 0
+	}
+
+	stripped := 0
+	for i := range batch.Data {
+		stripped += len(batch.Data[i].StringMetrics)
+		batch.Data[i].StringMetrics = []legacy.StringMetric{}
+	}
+	return stripped
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,269 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/mjolnir42/limit"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// testSink is an HTTP endpoint that records the bodies of all POST
+// requests
+type testSink struct {
+	*httptest.Server
+	lock   sync.Mutex
+	bodies [][]byte
+	status int
+	// number of following requests answered with 503
+	fail int
+}
+
+// newTestSink starts a testSink that answers with status
+func newTestSink(t *testing.T, status int) *testSink {
+	sink := &testSink{status: status}
+	sink.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			sink.lock.Lock()
+			if r.Method == http.MethodPost {
+				sink.bodies = append(sink.bodies, body)
+			}
+			status := sink.status
+			if sink.fail > 0 {
+				sink.fail--
+				status = http.StatusServiceUnavailable
+			}
+			sink.lock.Unlock()
+			w.WriteHeader(status)
+		}))
+	t.Cleanup(sink.Close)
+	return sink
+}
+
+// failNext answers the next n requests with 503
+func (s *testSink) failNext(n int) {
+	s.lock.Lock()
+	s.fail = n
+	s.lock.Unlock()
+}
+
+// posts returns the bodies of the received POST requests
+func (s *testSink) posts() [][]byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([][]byte{}, s.bodies...)
+}
+
+// newUnstartedHandler returns a handler as main creates it, to be run
+// by Start. options are the JSON encoded members of the dustdevil
+// settings section.
+func newUnstartedHandler(t *testing.T, format string, elastic bool, endpoint, options string) *DustDevil {
+	t.Helper()
+	conf := &erebos.Config{}
+	conf.DustDevil.Endpoint = endpoint
+	conf.DustDevil.InputFormat = format
+	conf.DustDevil.ForwardElastic = elastic
+	conf.DustDevil.RequestTimeout = 5000
+	conf.DustDevil.ConcurrencyLimit = 4
+
+	s := &Settings{}
+	if err := s.fromJSON([]byte(`{"dustdevil":{` + options +
+		`}}`)); err != nil {
+		t.Fatalf("Settings: %s", err)
+	}
+
+	registry := metrics.NewRegistry()
+	d := &DustDevil{
+		Num:      0,
+		Input:    make(chan *erebos.Transport, 8),
+		Shutdown: make(chan struct{}),
+		Death:    make(chan error, 8),
+		Config:   conf,
+		Settings: s,
+		Metrics:  &registry,
+		Limit:    limit.New(conf.DustDevil.ConcurrencyLimit),
+		Pool:     NewPool(conf, s),
+		Health:   NewHealth(s, 1),
+		Stats:    NewHostStats(s),
+	}
+	return d
+}
+
+// newTestHandler returns a handler set up like Start does, without
+// running its event loop. The Shutdown channel is closed, so that
+// errors are reported on Death instead of blocking the handler.
+func newTestHandler(t *testing.T, format string, elastic bool, endpoint, options string) *DustDevil {
+	t.Helper()
+	d := newUnstartedHandler(t, format, elastic, endpoint, options)
+	close(d.Shutdown)
+	if err := d.setup(); err != nil {
+		t.Fatalf("setup: %s", err)
+	}
+	return d
+}
+
+// testMessage returns a message consumed from partition 0 of topic
+// metrics with payload v
+func testMessage(t *testing.T, hostID int, offset int64, v interface{}) *erebos.Transport {
+	t.Helper()
+	value, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &erebos.Transport{
+		HostID: hostID,
+		Value:  value,
+		Topic:  `metrics`,
+		Offset: offset,
+		Commit: make(chan *erebos.Commit, 8),
+	}
+}
+
+// noDeath fails t if d reported an error
+func noDeath(t *testing.T, d *DustDevil) {
+	t.Helper()
+	select {
+	case err := <-d.Death:
+		t.Fatalf("Handler died: %s", err)
+	default:
+	}
+}
+
+// committed returns the number of commits of msgs
+func committed(msgs ...*erebos.Transport) int {
+	n := 0
+	for _, msg := range msgs {
+		n += len(msg.Commit)
+	}
+	return n
+}
+
+// TestStartSplit runs MetricSplit through the event loop of a started
+// handler, which releases the assembled batch on its own
+func TestStartSplit(t *testing.T) {
+	defer func(interval time.Duration) {
+		releaseInterval = interval
+	}(releaseInterval)
+	releaseInterval = 50 * time.Millisecond
+
+	sink := newTestSink(t, http.StatusOK)
+	d := newUnstartedHandler(t, `split`, false, sink.URL, ``)
+	done := make(chan struct{})
+	go func() {
+		d.Start()
+		close(done)
+	}()
+
+	ts := time.Now().UTC().Truncate(time.Second)
+	msgs := []*erebos.Transport{}
+	for i, path := range []string{`/sys/cpu/usage`, `/sys/load`} {
+		msg := testMessage(t, 42, int64(i+1), &legacy.MetricSplit{
+			HostID: 42,
+			TS:     ts,
+			Path:   path,
+			Type:   `real`,
+			Val:    legacy.MetricValue{FlpVal: float64(i)},
+		})
+		msgs = append(msgs, msg)
+		d.Input <- msg
+	}
+
+	// the other tickers of the event loop must not keep the release
+	// tick from firing
+	timeout := time.After(5 * time.Second)
+	for committed(msgs...) != len(msgs) {
+		select {
+		case d.Input <- erebos.NewHeartbeat():
+		case err := <-d.Death:
+			t.Fatalf("Handler died: %s", err)
+		case <-timeout:
+			t.Fatalf("Committed %d of %d messages", committed(msgs...),
+				len(msgs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(sink.posts()); n != 1 {
+		t.Errorf("Received %d POST requests, expected 1", n)
+	}
+
+	close(d.Shutdown)
+	close(d.Input)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`Handler did not shut down`)
+	}
+}
+
+// TestProcessFailure checks that a failing endpoint is reported on
+// Death for every input format and sink
+func TestProcessFailure(t *testing.T) {
+	split := &legacy.MetricSplit{
+		HostID: 7,
+		TS:     time.Now().UTC(),
+		Path:   `/sys/load`,
+		Type:   `real`,
+		Val:    legacy.MetricValue{FlpVal: 0.5},
+	}
+	batch := &legacy.MetricBatch{
+		HostID: 7,
+		Data: []legacy.MetricData{{
+			Time: split.TS,
+			FloatMetrics: []legacy.FloatMetric{{
+				Metric: `/sys/load`,
+				Value:  0.5,
+			}},
+		}},
+	}
+
+	for _, format := range []string{`batch`, `split`} {
+		for _, elastic := range []bool{false, true} {
+			sink := newTestSink(t, http.StatusBadRequest)
+			d := newTestHandler(t, format, elastic, sink.URL, ``)
+
+			var msg *erebos.Transport
+			switch format {
+			case `batch`:
+				msg = testMessage(t, 7, 1, batch)
+			case `split`:
+				msg = testMessage(t, 7, 1, split)
+			}
+			d.process(msg)
+			if format == `split` {
+				d.assemblyLock.Lock()
+				d.release()
+				d.assemblyLock.Unlock()
+			}
+			d.delay.Wait()
+
+			select {
+			case <-d.Death:
+			default:
+				t.Errorf("%s elastic=%t: rejected POST was not"+
+					" reported", format, elastic)
+			}
+			if committed(msg) != 0 {
+				t.Errorf("%s elastic=%t: message of rejected POST"+
+					" was committed", format, elastic)
+			}
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,134 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/solnx/legacy"
+	"github.com/vmihailenco/msgpack"
+)
+
+var (
+	// MessagePack encoded messages use the same map keys as the
+	// JSON encoding, the host ID keys are used to peek the host ID
+	// without decoding the full message
+	batchHostIDKey = jsonFieldName(legacy.MetricBatch{}, `HostID`)
+	splitHostIDKey = jsonFieldName(legacy.MetricSplit{}, `HostID`)
+)
+
+// jsonFieldName returns the JSON object key of field in v
+func jsonFieldName(v interface{}, field string) string {
+	f, ok := reflect.TypeOf(v).FieldByName(field)
+	if !ok {
+		return field
+	}
+	name := strings.Split(f.Tag.Get(`json`), `,`)[0]
+	if name == `` {
+		return field
+	}
+	return name
+}
+
+// inputEncoding returns the wire format of a message consumed from
+// topic
+func inputEncoding(s *Settings, topic string, value []byte) string {
+	enc := s.DustDevil.InputEncoding
+	if e, ok := s.DustDevil.TopicEncoding[topic]; ok {
+		enc = e
+	}
+	if enc == `auto` {
+		enc = detectEncoding(value)
+	}
+	return enc
+}
+
+// detectEncoding returns the wire format of value. JSON messages are
+// objects, MessagePack messages are maps.
+func detectEncoding(value []byte) string {
+	value = bytes.TrimLeft(value, " \t\r\n")
+	if len(value) == 0 {
+		return `json`
+	}
+	switch {
+	case value[0] >= 0x80 && value[0] <= 0x8f:
+		// fixmap
+		return `msgpack`
+	case value[0] == 0xde, value[0] == 0xdf:
+		// map16, map32
+		return `msgpack`
+	}
+	return `json`
+}
+
+// peekHostID returns the host ID of value, which is encoded in
+// format enc
+func peekHostID(value []byte, enc string) (int, error) {
+	switch enc {
+	case `json`:
+		return legacy.PeekHostID(value)
+	case `msgpack`:
+		for _, key := range []string{batchHostIDKey, splitHostIDKey} {
+			res, err := msgpack.NewDecoder(
+				bytes.NewReader(value),
+			).Query(key)
+			if err != nil {
+				return 0, err
+			}
+			if len(res) == 0 {
+				continue
+			}
+			return msgpackInt(res[0])
+		}
+		return 0, fmt.Errorf("MessagePack message contains no hostID")
+	}
+	return 0, fmt.Errorf("Unknown input encoding: %s", enc)
+}
+
+// unmarshal decodes value in format enc into v
+func unmarshal(value []byte, enc string, v interface{}) error {
+	switch enc {
+	case `json`:
+		return json.Unmarshal(value, v)
+	case `msgpack`:
+		return msgpack.NewDecoder(
+			bytes.NewReader(value),
+		).UseJSONTag(true).Decode(v)
+	}
+	return fmt.Errorf("Unknown input encoding: %s", enc)
+}
+
+// msgpackInt converts a decoded MessagePack integer to int
+func msgpackInt(v interface{}) (int, error) {
+	switch i := v.(type) {
+	case int8:
+		return int(i), nil
+	case int16:
+		return int(i), nil
+	case int32:
+		return int(i), nil
+	case int64:
+		return int(i), nil
+	case uint8:
+		return int(i), nil
+	case uint16:
+		return int(i), nil
+	case uint32:
+		return int(i), nil
+	case uint64:
+		return int(i), nil
+	}
+	return 0, fmt.Errorf("MessagePack hostID is not an integer: %v", v)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
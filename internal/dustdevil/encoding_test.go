@@ -0,0 +1,195 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/solnx/legacy"
+	"github.com/vmihailenco/msgpack"
+)
+
+// msgpackJSON encodes v as MessagePack map with the JSON keys of v
+func msgpackJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := msgpack.NewEncoder(buf).UseJSONTag(true).
+		Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectEncoding(t *testing.T) {
+	tests := []struct {
+		value []byte
+		enc   string
+	}{
+		{value: []byte(`{"host_id":1}`), enc: `json`},
+		{value: []byte(" \n\t{}"), enc: `json`},
+		{value: []byte{}, enc: `json`},
+		{value: []byte{0x81, 0xa1, 'a', 0x01}, enc: `msgpack`},
+		{value: []byte{0x80}, enc: `msgpack`},
+		{value: []byte{0x8f}, enc: `msgpack`},
+		{value: []byte{0xde, 0x00, 0x10}, enc: `msgpack`},
+		{value: []byte{0xdf, 0x00, 0x00, 0x00, 0x10}, enc: `msgpack`},
+		// MessagePack arrays are no messages
+		{value: []byte{0x91, 0x01}, enc: `json`},
+	}
+
+	for _, tc := range tests {
+		if enc := detectEncoding(tc.value); enc != tc.enc {
+			t.Errorf("detectEncoding(%x) = %s, expected %s",
+				tc.value, enc, tc.enc)
+		}
+	}
+}
+
+func TestInputEncoding(t *testing.T) {
+	s := &Settings{}
+	if err := s.fromJSON([]byte(`{"dustdevil":{
+		"input.encoding":"json",
+		"input.encoding.topics":{"packed":"msgpack","mixed":"auto"}
+	}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		topic string
+		value []byte
+		enc   string
+	}{
+		{topic: `metrics`, value: []byte{0x81}, enc: `json`},
+		{topic: `packed`, value: []byte(`{}`), enc: `msgpack`},
+		{topic: `mixed`, value: []byte(`{}`), enc: `json`},
+		{topic: `mixed`, value: []byte{0x81}, enc: `msgpack`},
+	}
+
+	for _, tc := range tests {
+		if enc := inputEncoding(s, tc.topic, tc.value); enc != tc.enc {
+			t.Errorf("inputEncoding(%s, %x) = %s, expected %s",
+				tc.topic, tc.value, enc, tc.enc)
+		}
+	}
+}
+
+func TestPeekHostID(t *testing.T) {
+	batch := legacy.MetricBatch{HostID: 42, Protocol: 1}
+	split := legacy.MetricSplit{HostID: 4242, Path: `/sys/load`}
+	jsonBatch, err := json.Marshal(&batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonSplit, err := json.Marshal(&split)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		value  []byte
+		enc    string
+		hostID int
+		valid  bool
+	}{
+		{`json batch`, jsonBatch, `json`, 42, true},
+		{`json split`, jsonSplit, `json`, 4242, true},
+		{`msgpack batch`, msgpackJSON(t, &batch), `msgpack`, 42, true},
+		{`msgpack split`, msgpackJSON(t, &split), `msgpack`, 4242, true},
+		{`msgpack without hostID`, msgpackJSON(t,
+			map[string]int{`other`: 1}), `msgpack`, 0, false},
+		{`msgpack string hostID`, msgpackJSON(t, map[string]string{
+			batchHostIDKey: `42`}), `msgpack`, 0, false},
+		{`unknown encoding`, jsonBatch, `xml`, 0, false},
+	}
+
+	for _, tc := range tests {
+		hostID, err := peekHostID(tc.value, tc.enc)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: valid=%t, error: %v", tc.name, tc.valid, err)
+			continue
+		}
+		if tc.valid && hostID != tc.hostID {
+			t.Errorf("%s: hostID %d, expected %d", tc.name, hostID,
+				tc.hostID)
+		}
+	}
+}
+
+func TestUnmarshalMsgpack(t *testing.T) {
+	ts := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	in := legacy.MetricSplit{
+		HostID: 42,
+		TS:     ts,
+		Path:   `/sys/memory/free`,
+		Type:   `integer`,
+		Val:    legacy.MetricValue{IntVal: 1024},
+		Tags:   []string{`tag`},
+	}
+
+	for _, enc := range []string{`json`, `msgpack`} {
+		var value []byte
+		switch enc {
+		case `json`:
+			var err error
+			if value, err = json.Marshal(&in); err != nil {
+				t.Fatal(err)
+			}
+		case `msgpack`:
+			value = msgpackJSON(t, &in)
+		}
+
+		out := legacy.MetricSplit{}
+		if err := unmarshal(value, enc, &out); err != nil {
+			t.Errorf("%s: %s", enc, err)
+			continue
+		}
+		if out.HostID != in.HostID || !out.TS.Equal(in.TS) ||
+			out.Path != in.Path || out.Type != in.Type ||
+			out.Val.IntVal != in.Val.IntVal ||
+			len(out.Tags) != 1 || out.Tags[0] != `tag` {
+			t.Errorf("%s: decoded %+v, expected %+v", enc, out, in)
+		}
+	}
+
+	if err := unmarshal([]byte(`{}`), `xml`,
+		&legacy.MetricSplit{}); err == nil {
+		t.Error(`unmarshal with unknown encoding did not fail`)
+	}
+}
+
+func TestInputEncodingSetting(t *testing.T) {
+	tests := []struct {
+		options string
+		valid   bool
+	}{
+		{options: ``, valid: true},
+		{options: `"input.encoding":"json"`, valid: true},
+		{options: `"input.encoding":"msgpack"`, valid: true},
+		{options: `"input.encoding":"protobuf"`, valid: false},
+		{options: `"input.encoding.topics":{"a":"msgpack"}`,
+			valid: true},
+		{options: `"input.encoding.topics":{"a":"msgpak"}`,
+			valid: false},
+	}
+
+	for _, tc := range tests {
+		s := &Settings{}
+		err := s.fromJSON([]byte(`{"dustdevil":{` + tc.options + `}}`))
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: valid=%t, error: %v", tc.options, tc.valid,
+				err)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,206 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/legacy"
+)
+
+// fakeThresholds is a thresholdLookup with the thresholds of lookup
+// IDs, all other IDs are unconfigured
+type fakeThresholds map[string]map[string]wall.Threshold
+
+// LookupThreshold implements thresholdLookup
+func (f fakeThresholds) LookupThreshold(id string) (map[string]wall.Threshold, error) {
+	if thr, ok := f[id]; ok {
+		return thr, nil
+	}
+	return nil, wall.ErrUnconfigured
+}
+
+// configured returns a fakeThresholds with one profile for every
+// metric path of hostID, whose configuration ID is the value of paths
+func configured(hostID int, paths map[string]string) fakeThresholds {
+	f := fakeThresholds{}
+	for path, id := range paths {
+		f[wall.CalculateLookupID(uint64(hostID), path)] =
+			map[string]wall.Threshold{id: {ID: id, Metric: path}}
+	}
+	return f
+}
+
+// TestEnrich runs metrics through processBatchElastic and checks
+// which documents are sent with which profile. Profiles are always
+// looked up by the path the producer sent.
+func TestEnrich(t *testing.T) {
+	relabelLoad := `,"relabel":[{"source":"path","target":"path",` +
+		`"regex":"/sys/load","replacement":"/host/load"}]`
+	relabelOther := `,"relabel":[{"source":"path","target":"path",` +
+		`"regex":"/sys/other","replacement":"/sys/load"}]`
+	rate := `,"rate.counter.paths":["/net/bytes"]`
+
+	tests := []struct {
+		name    string
+		options string
+		path    string
+		// configuration IDs of the sent documents, empty for a
+		// document without profile
+		profiles []string
+	}{
+		{name: `configured`, path: `/sys/load`,
+			profiles: []string{`load`}},
+		{name: `unconfigured is dropped`, path: `/sys/other`,
+			profiles: []string{}},
+		{name: `unconfigured is kept`, path: `/sys/other`,
+			options:  `,"enrich.drop.unconfigured":"false"`,
+			profiles: []string{``}},
+		{name: `relabeled keeps its profile`, path: `/sys/load`,
+			options: relabelLoad, profiles: []string{`load`}},
+		{name: `relabeled onto a configured path is dropped`,
+			path: `/sys/other`, options: relabelOther,
+			profiles: []string{}},
+		{name: `rate has the profile of its counter`,
+			path: `/net/bytes`, options: rate,
+			profiles: []string{`bytes`}},
+		{name: `relabeled unconfigured keeps no profile`,
+			path: `/sys/other`,
+			options: relabelOther +
+				`,"enrich.drop.unconfigured":"false"`,
+			profiles: []string{``}},
+	}
+
+	ts := time.Now().UTC().Truncate(time.Second)
+	for _, format := range []string{`batch`, `split`} {
+		for _, tc := range tests {
+			t.Run(format+`/`+tc.name, func(t *testing.T) {
+				sink := newTestSink(t, http.StatusOK)
+				d := newTestHandler(t, format, true, sink.URL,
+					`"enrich.profiles":"true",`+
+						`"enrich.drop.unconfigured":"true"`+tc.options)
+				d.thresholds = configured(5, map[string]string{
+					`/sys/load`:  `load`,
+					`/net/bytes`: `bytes`,
+				})
+
+				// two samples, so that counters yield one rate
+				offsets := []time.Duration{-10, 0}
+				if tc.path != `/net/bytes` {
+					offsets = offsets[1:]
+				}
+				msgs := enrichMessages(t, format, tc.path, ts, offsets)
+				for _, msg := range msgs {
+					d.process(msg)
+				}
+				if format == `split` {
+					d.assemblyLock.Lock()
+					d.release()
+					d.assemblyLock.Unlock()
+				}
+				d.delay.Wait()
+				noDeath(t, d)
+
+				posts := sink.posts()
+				if len(posts) != len(tc.profiles) {
+					t.Fatalf("Sent %d documents, expected %d",
+						len(posts), len(tc.profiles))
+				}
+				for i, body := range posts {
+					doc := struct {
+						Profiles []profile `json:"profiles"`
+					}{}
+					if err := json.Unmarshal(body, &doc); err != nil {
+						t.Fatal(err)
+					}
+					id := ``
+					if len(doc.Profiles) > 0 {
+						id = doc.Profiles[0].ConfigurationID
+					}
+					if id != tc.profiles[i] {
+						t.Errorf("Document %d has profile %q,"+
+							" expected %q", i, id, tc.profiles[i])
+					}
+				}
+				if n := committed(msgs...); n != len(msgs) {
+					t.Errorf("Committed %d of %d messages", n,
+						len(msgs))
+				}
+			})
+		}
+	}
+}
+
+// enrichMessages returns the messages of host 5 in format with the
+// integer samples of path at ts plus offsets
+func enrichMessages(t *testing.T, format, path string, ts time.Time, offsets []time.Duration) []*erebos.Transport {
+	t.Helper()
+	msgs := []*erebos.Transport{}
+	batch := &legacy.MetricBatch{HostID: 5}
+	for i, offset := range offsets {
+		value := int64(100 * (i + 1))
+		switch format {
+		case `batch`:
+			batch.Data = append(batch.Data, legacy.MetricData{
+				Time: ts.Add(offset * time.Second),
+				IntMetrics: []legacy.IntMetric{
+					{Metric: path, Value: value},
+				},
+			})
+		case `split`:
+			msgs = append(msgs, testMessage(t, 5, int64(i+1),
+				&legacy.MetricSplit{
+					HostID: 5,
+					TS:     ts.Add(offset * time.Second),
+					Path:   path,
+					Type:   `integer`,
+					Val:    legacy.MetricValue{IntVal: value},
+				}))
+		}
+	}
+	if format == `batch` {
+		msgs = append(msgs, testMessage(t, 5, 1, batch))
+	}
+	return msgs
+}
+
+func TestProfileCacheOrigin(t *testing.T) {
+	c := newProfileCache()
+	c.derive(`/host/load`, `a`, `/sys/load`, `a`)
+	c.derive(`/host/load.rate`, `a`, `/host/load`, `a`)
+	c.derive(`/sys/cpu`, ``, `/sys/cpu`, ``)
+
+	tests := []struct {
+		path    string
+		subtype string
+		origin  string
+	}{
+		{`/host/load`, `a`, `/sys/load`},
+		{`/host/load.rate`, `a`, `/sys/load`},
+		{`/host/load`, `b`, `/host/load`},
+		{`/sys/cpu`, ``, `/sys/cpu`},
+	}
+
+	for _, tc := range tests {
+		if o := c.origin(tc.path, tc.subtype); o != tc.origin {
+			t.Errorf("Origin of %s/%s is %s, expected %s", tc.path,
+				tc.subtype, o, tc.origin)
+		}
+	}
+	if len(c.origins) != 2 {
+		t.Errorf("Recorded %d origins, expected 2", len(c.origins))
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,133 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Filter is a metric filter rule. Rules are evaluated in order and
+// the action of the first rule whose set match conditions are all met
+// is applied. Metrics that match no rule are forwarded.
+type Filter struct {
+	// name of the rule, used in metrics
+	Name string `json:"name"`
+	// either include or exclude
+	Action string `json:"action"`
+	// shell glob matched against the metric path
+	PathGlob string `json:"path.glob"`
+	// regular expression matched against the metric path
+	PathRegex string `json:"path.regex"`
+	// metric subtype, ie. the tag of a split metric
+	Subtype string `json:"subtype"`
+	// comma separated list of metric types, real, integer, long or
+	// string
+	Types string `json:"types"`
+	// comma separated list of host IDs and host ID ranges
+	HostIDs string `json:"host.ids"`
+}
+
+// filter is the compiled form of a Filter
+type filter struct {
+	name    string
+	exclude bool
+	glob    string
+	regex   *regexp.Regexp
+	subtype string
+	types   map[string]struct{}
+	hosts   *hostSet
+}
+
+// compileFilter returns the compiled form of f
+func compileFilter(f Filter) (*filter, error) {
+	var err error
+
+	if f.Name == `` {
+		return nil, fmt.Errorf("Filter without name")
+	}
+
+	c := &filter{
+		name:    f.Name,
+		glob:    f.PathGlob,
+		subtype: f.Subtype,
+		types:   make(map[string]struct{}),
+	}
+
+	switch f.Action {
+	case `include`:
+	case `exclude`:
+		c.exclude = true
+	default:
+		return nil, fmt.Errorf("Filter %s: unknown action %s",
+			f.Name, f.Action)
+	}
+
+	if c.glob != `` {
+		if _, err = path.Match(c.glob, ``); err != nil {
+			return nil, fmt.Errorf("Filter %s: %s", f.Name, err)
+		}
+	}
+	if f.PathRegex != `` {
+		if c.regex, err = regexp.Compile(f.PathRegex); err != nil {
+			return nil, fmt.Errorf("Filter %s: %s", f.Name, err)
+		}
+	}
+	for _, t := range strings.Split(f.Types, `,`) {
+		switch t = strings.TrimSpace(t); t {
+		case ``:
+		case `real`, `integer`, `long`, `string`:
+			c.types[t] = struct{}{}
+		default:
+			return nil, fmt.Errorf("Filter %s: unknown type %s",
+				f.Name, t)
+		}
+	}
+	if c.hosts, err = parseHostSet(f.HostIDs); err != nil {
+		return nil, fmt.Errorf("Filter %s: %s", f.Name, err)
+	}
+	return c, nil
+}
+
+// match returns true if the rule applies to the described metric.
+// Integer metrics of a MetricBatch carry no distinction between
+// integer and long and match either type.
+func (f *filter) match(hostID int, metricPath, subtype string, types ...string) bool {
+	if !f.hosts.empty() && !f.hosts.contains(hostID) {
+		return false
+	}
+	if f.subtype != `` && f.subtype != subtype {
+		return false
+	}
+	if len(f.types) > 0 {
+		found := false
+		for _, t := range types {
+			if _, ok := f.types[t]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.glob != `` {
+		if ok, _ := path.Match(f.glob, metricPath); !ok {
+			return false
+		}
+	}
+	if f.regex != nil && !f.regex.MatchString(metricPath) {
+		return false
+	}
+	return true
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
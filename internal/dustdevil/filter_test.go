@@ -0,0 +1,223 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"testing"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+func TestCompileFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		valid  bool
+	}{
+		{`minimal`, Filter{Name: `a`, Action: `include`}, true},
+		{`all conditions`, Filter{Name: `a`, Action: `exclude`,
+			PathGlob: `/sys/*`, PathRegex: `^/sys/`, Subtype: `eth0`,
+			Types: `real, integer,long,string`, HostIDs: `1,5-9`},
+			true},
+		{`without name`, Filter{Action: `include`}, false},
+		{`unknown action`, Filter{Name: `a`, Action: `drop`}, false},
+		{`broken glob`, Filter{Name: `a`, Action: `include`,
+			PathGlob: `/sys/[`}, false},
+		{`broken regex`, Filter{Name: `a`, Action: `include`,
+			PathRegex: `(`}, false},
+		{`unknown type`, Filter{Name: `a`, Action: `include`,
+			Types: `real,float`}, false},
+		{`broken host IDs`, Filter{Name: `a`, Action: `include`,
+			HostIDs: `1,x`}, false},
+	}
+
+	for _, tc := range tests {
+		if _, err := compileFilter(tc.filter); (err == nil) != tc.valid {
+			t.Errorf("%s: valid=%t, error: %v", tc.name, tc.valid, err)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  Filter
+		hostID  int
+		path    string
+		subtype string
+		types   []string
+		match   bool
+	}{
+		{`no conditions`, Filter{}, 1, `/sys/load`, ``,
+			[]string{`real`}, true},
+		{`glob`, Filter{PathGlob: `/sys/*`}, 1, `/sys/load`, ``,
+			[]string{`real`}, true},
+		{`glob mismatch`, Filter{PathGlob: `/sys/*`}, 1,
+			`/sys/cpu/usage`, ``, []string{`real`}, false},
+		{`regex`, Filter{PathRegex: `^/sys/cpu/`}, 1,
+			`/sys/cpu/usage`, ``, []string{`real`}, true},
+		{`regex mismatch`, Filter{PathRegex: `^/sys/cpu/`}, 1,
+			`/sys/load`, ``, []string{`real`}, false},
+		{`subtype`, Filter{Subtype: `eth0`}, 1, `/net/bytes`, `eth0`,
+			[]string{`integer`}, true},
+		{`subtype mismatch`, Filter{Subtype: `eth0`}, 1, `/net/bytes`,
+			`eth1`, []string{`integer`}, false},
+		{`type`, Filter{Types: `string`}, 1, `/sys/os`, ``,
+			[]string{`string`}, true},
+		{`type mismatch`, Filter{Types: `string`}, 1, `/sys/load`, ``,
+			[]string{`real`}, false},
+		{`batch integer as long`, Filter{Types: `long`}, 1,
+			`/sys/memory/free`, ``, []string{`integer`, `long`}, true},
+		{`host range`, Filter{HostIDs: `5-9`}, 7, `/sys/load`, ``,
+			[]string{`real`}, true},
+		{`host mismatch`, Filter{HostIDs: `5-9`}, 10, `/sys/load`, ``,
+			[]string{`real`}, false},
+		{`all conditions`, Filter{PathGlob: `/net/*`,
+			PathRegex: `bytes$`, Subtype: `eth0`, Types: `integer`,
+			HostIDs: `1`}, 1, `/net/bytes`, `eth0`,
+			[]string{`integer`}, true},
+		{`one condition fails`, Filter{PathGlob: `/net/*`,
+			PathRegex: `bytes$`, Subtype: `eth0`, Types: `integer`,
+			HostIDs: `1`}, 2, `/net/bytes`, `eth0`,
+			[]string{`integer`}, false},
+	}
+
+	for _, tc := range tests {
+		tc.filter.Name = tc.name
+		tc.filter.Action = `include`
+		f, err := compileFilter(tc.filter)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if m := f.match(tc.hostID, tc.path, tc.subtype,
+			tc.types...); m != tc.match {
+			t.Errorf("%s: match=%t, expected %t", tc.name, m, tc.match)
+		}
+	}
+}
+
+// testFilters are an ordered rule set: load metrics of host 1 are
+// kept before all /sys metrics are dropped, string metrics are dropped
+// everywhere
+const testFilters = `"filters":[
+	{"name":"keep-load","action":"include","path.glob":"/sys/load",
+	 "host.ids":"1"},
+	{"name":"drop-sys","action":"exclude","path.glob":"/sys/*"},
+	{"name":"drop-strings","action":"exclude","types":"string"}
+]`
+
+func TestKeep(t *testing.T) {
+	d := newTestHandler(t, `batch`, false, ``, testFilters)
+
+	tests := []struct {
+		hostID  int
+		path    string
+		typ     string
+		keep    bool
+		dropped string
+	}{
+		{hostID: 1, path: `/sys/load`, typ: `real`, keep: true},
+		{hostID: 2, path: `/sys/load`, typ: `real`, keep: false,
+			dropped: `drop-sys`},
+		{hostID: 1, path: `/sys/os`, typ: `string`, keep: false,
+			dropped: `drop-sys`},
+		{hostID: 1, path: `/app/version`, typ: `string`, keep: false,
+			dropped: `drop-strings`},
+		{hostID: 1, path: `/app/requests`, typ: `integer`, keep: true},
+	}
+
+	for _, tc := range tests {
+		counters := map[string]int64{}
+		for _, name := range []string{`drop-sys`, `drop-strings`} {
+			counters[name] = metrics.GetOrRegisterCounter(
+				`/filter/`+name+`/dropped`, *d.Metrics).Count()
+		}
+
+		if k := d.keep(tc.hostID, tc.path, ``, tc.typ); k != tc.keep {
+			t.Errorf("%d %s %s: keep=%t, expected %t", tc.hostID,
+				tc.path, tc.typ, k, tc.keep)
+		}
+		for name, before := range counters {
+			expected := before
+			if name == tc.dropped {
+				expected++
+			}
+			if n := metrics.GetOrRegisterCounter(
+				`/filter/`+name+`/dropped`,
+				*d.Metrics).Count(); n != expected {
+				t.Errorf("%d %s %s: %s dropped %d, expected %d",
+					tc.hostID, tc.path, tc.typ, name, n, expected)
+			}
+		}
+	}
+}
+
+func TestFilterBatchAndSplit(t *testing.T) {
+	d := newTestHandler(t, `batch`, false, ``, testFilters)
+
+	batch := &legacy.MetricBatch{
+		HostID: 2,
+		Data: []legacy.MetricData{{
+			FloatMetrics: []legacy.FloatMetric{
+				{Metric: `/sys/load`},
+				{Metric: `/app/latency`},
+			},
+			IntMetrics: []legacy.IntMetric{
+				{Metric: `/sys/swap`},
+				{Metric: `/app/requests`},
+			},
+			StringMetrics: []legacy.StringMetric{
+				{Metric: `/app/version`},
+			},
+		}},
+	}
+	d.filterBatch(batch)
+	data := batch.Data[0]
+	if len(data.FloatMetrics) != 1 ||
+		data.FloatMetrics[0].Metric != `/app/latency` ||
+		len(data.IntMetrics) != 1 ||
+		data.IntMetrics[0].Metric != `/app/requests` ||
+		len(data.StringMetrics) != 0 {
+		t.Errorf("Filtered batch: %+v", data)
+	}
+
+	tests := []struct {
+		split legacy.MetricSplit
+		tags  int
+	}{
+		{legacy.MetricSplit{HostID: 1, Path: `/sys/load`,
+			Type: `real`, Tags: []string{`a`, `b`}}, 2},
+		{legacy.MetricSplit{HostID: 2, Path: `/sys/load`,
+			Type: `real`, Tags: []string{`a`, `b`}}, 0},
+		{legacy.MetricSplit{HostID: 2, Path: `/app/latency`,
+			Type: `real`, Tags: []string{`a`}}, 1},
+	}
+
+	for _, tc := range tests {
+		split := tc.split
+		d.filterSplit(&split)
+		if len(split.Tags) != tc.tags {
+			t.Errorf("%d %s: kept tags %v, expected %d",
+				split.HostID, split.Path, split.Tags, tc.tags)
+		}
+	}
+
+	// without rules nothing is filtered
+	d = newTestHandler(t, `batch`, false, ``, ``)
+	split := legacy.MetricSplit{HostID: 2, Path: `/sys/load`,
+		Type: `real`, Tags: []string{`a`}}
+	d.filterSplit(&split)
+	if len(split.Tags) != 1 {
+		t.Errorf("Split filtered without rules: %v", split.Tags)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -11,6 +11,7 @@ package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
 import (
 	"fmt"
 	"os"
+	"time"
 
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/solnx/legacy"
@@ -30,10 +31,74 @@ func FormatMetrics(batch *legacy.PluginMetricBatch) func(string, interface{}) {
 					FlpVal: value.Rate1(),
 				},
 			})
+		case *metrics.StandardCounter:
+			value := v.(*metrics.StandardCounter)
+			batch.Metrics = append(batch.Metrics, legacy.PluginMetric{
+				Type:   `integer`,
+				Metric: metric,
+				Value: legacy.MetricValue{
+					IntVal: value.Count(),
+				},
+			})
+		case *metrics.StandardGauge:
+			value := v.(*metrics.StandardGauge)
+			batch.Metrics = append(batch.Metrics, legacy.PluginMetric{
+				Type:   `integer`,
+				Metric: metric,
+				Value: legacy.MetricValue{
+					IntVal: value.Value(),
+				},
+			})
+		case *metrics.StandardHistogram:
+			value := v.(*metrics.StandardHistogram).Snapshot()
+			batch.Metrics = append(batch.Metrics,
+				distribution(metric, value.Count(), value.Mean(),
+					value.Percentiles(percentiles), 1)...)
+		case *metrics.StandardTimer:
+			value := v.(*metrics.StandardTimer).Snapshot()
+			batch.Metrics = append(batch.Metrics,
+				distribution(metric, value.Count(), value.Mean(),
+					value.Percentiles(percentiles),
+					float64(time.Millisecond))...)
 		}
 	}
 }
 
+// percentiles exported for histograms and timers
+var percentiles = []float64{0.5, 0.95, 0.99}
+
+// distribution returns the PluginMetric of a histogram or timer. The
+// mean and percentile values are divided by scale, which converts
+// timer values from nanoseconds to milliseconds.
+func distribution(metric string, count int64, mean float64, ps []float64, scale float64) []legacy.PluginMetric {
+	m := []legacy.PluginMetric{
+		{
+			Type:   `integer`,
+			Metric: fmt.Sprintf("%s/count", metric),
+			Value: legacy.MetricValue{
+				IntVal: count,
+			},
+		},
+		{
+			Type:   `float`,
+			Metric: fmt.Sprintf("%s/mean", metric),
+			Value: legacy.MetricValue{
+				FlpVal: mean / scale,
+			},
+		},
+	}
+	for i, p := range percentiles {
+		m = append(m, legacy.PluginMetric{
+			Type:   `float`,
+			Metric: fmt.Sprintf("%s/p%g", metric, p*100),
+			Value: legacy.MetricValue{
+				FlpVal: ps[i] / scale,
+			},
+		})
+	}
+	return m
+}
+
 // DebugFormatMetrics is the formatting function to print DustDevil metrics
 // on STDERR
 func DebugFormatMetrics(_ *legacy.PluginMetricBatch) func(string, interface{}) {
@@ -43,6 +108,36 @@ func DebugFormatMetrics(_ *legacy.PluginMetricBatch) func(string, interface{}) {
 			value := v.(*metrics.StandardMeter)
 			fmt.Fprintf(os.Stderr, "%s/avg/rate/1min: %f\n",
 				metric, value.Rate1())
+		case *metrics.StandardCounter:
+			value := v.(*metrics.StandardCounter)
+			fmt.Fprintf(os.Stderr, "%s: %d\n", metric, value.Count())
+		case *metrics.StandardGauge:
+			value := v.(*metrics.StandardGauge)
+			fmt.Fprintf(os.Stderr, "%s: %d\n", metric, value.Value())
+		case *metrics.StandardHistogram:
+			value := v.(*metrics.StandardHistogram).Snapshot()
+			debugDistribution(distribution(metric, value.Count(),
+				value.Mean(), value.Percentiles(percentiles), 1))
+		case *metrics.StandardTimer:
+			value := v.(*metrics.StandardTimer).Snapshot()
+			debugDistribution(distribution(metric, value.Count(),
+				value.Mean(), value.Percentiles(percentiles),
+				float64(time.Millisecond)))
+		}
+	}
+}
+
+// debugDistribution prints the PluginMetric of a histogram or timer
+// on STDERR
+func debugDistribution(m []legacy.PluginMetric) {
+	for _, pm := range m {
+		switch pm.Type {
+		case `integer`:
+			fmt.Fprintf(os.Stderr, "%s: %d\n", pm.Metric,
+				pm.Value.IntVal)
+		default:
+			fmt.Fprintf(os.Stderr, "%s: %f\n", pm.Metric,
+				pm.Value.FlpVal)
 		}
 	}
 }
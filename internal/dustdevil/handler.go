@@ -13,35 +13,73 @@ import (
 	"time"
 
 	"github.com/go-resty/resty"
+	"github.com/klauspost/compress/zstd"
 	"github.com/mjolnir42/delay"
 	"github.com/mjolnir42/erebos"
 	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/legacy"
 )
 
 // Implementation of the erebos.Handler interface
 
 // Start sets up the DustDevil application
 func (d *DustDevil) Start() {
+	if err := d.setup(); err != nil {
+		d.Death <- d.fail(err, nil)
+		<-d.Shutdown
+		return
+	}
+	defer d.lookup.Close()
+	d.run()
+}
+
+// setup initializes the unexported state of the handler
+func (d *DustDevil) setup() error {
+	// retries are not handled by the client but by post, which
+	// fails over across the endpoint pool and counts them
 	d.client = resty.New()
 	d.client = d.client.SetRedirectPolicy(
 		resty.FlexibleRedirectPolicy(15)).
 		SetDisableWarn(true).
-		SetRetryCount(d.Config.DustDevil.RetryCount).
-		SetRetryWaitTime(
-			time.Duration(d.Config.DustDevil.RetryMinWaitTime)*
-				time.Millisecond).
-		SetRetryMaxWaitTime(
-			time.Duration(d.Config.DustDevil.RetryMaxWaitTime)*
-				time.Millisecond).
+		SetRetryCount(0).
 		SetHeader(`Content-Type`, `application/json`).
 		SetContentLength(true)
 
+	// zstd encoders are safe for concurrent use via EncodeAll
+	if d.Settings.DustDevil.OutputCompression == `zstd` {
+		var err error
+		level := zstd.SpeedDefault
+		if d.Settings.DustDevil.OutputCompressionLevel != 0 {
+			level = zstd.EncoderLevelFromZstd(
+				d.Settings.DustDevil.OutputCompressionLevel)
+		}
+		if d.zstdEncoder, err = zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(level)); err != nil {
+			return err
+		}
+	}
+
 	d.lookup = wall.NewLookup(d.Config, `dustdevil`)
-	defer d.lookup.Close()
+	d.thresholds = d.lookup
 
 	d.delay = delay.New()
 	d.assemblyLock = sync.Mutex{}
-	d.run()
+	d.assembly = make(map[int]map[time.Time]legacy.MetricData)
+	d.assemblyCommit = make(map[int][]*erebos.Transport)
+	d.assemblyProfiles = make(map[int]*profileCache)
+	d.aggregation = make(map[string]*aggregation)
+	d.controlC = make(chan func())
+	d.rates = newRateState(d.Settings.DustDevil.RateCounterBits,
+		d.Settings.DustDevil.RateWrapMargin)
+	if d.Settings.DustDevil.DownsampleWindow > 0 {
+		d.downsample = newDownsampler(
+			time.Duration(d.Settings.DustDevil.DownsampleWindow)*
+				time.Second,
+			time.Duration(d.Settings.DustDevil.DownsampleGrace)*
+				time.Second,
+		)
+	}
+	return nil
 }
 
 // InputChannel returns the data input channel
@@ -0,0 +1,220 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// health is the Health used by Dispatch
+var health *Health
+
+// Health tracks the liveness and readiness of DustDevil. It is
+// shared by main, Dispatch and all handlers.
+type Health struct {
+	lock     sync.Mutex
+	consumer bool
+	mainTick time.Time
+	// event loop iterations of the handlers
+	loops       map[int]time.Time
+	beats       map[int]time.Time
+	processed   map[int]time.Time
+	lastSuccess time.Time
+	lastFailure time.Time
+	// handlers without heartbeat for this long are not ready
+	readyAfter time.Duration
+	// main loop or handlers without progress for this long are
+	// not alive
+	liveAfter time.Duration
+	// a failing endpoint is not ready after this long without a
+	// successful POST
+	postWindow time.Duration
+}
+
+// NewHealth returns the Health configured in s for the given number
+// of handlers
+func NewHealth(s *Settings, handlers int) *Health {
+	now := time.Now()
+	h := &Health{
+		mainTick:  now,
+		loops:     make(map[int]time.Time),
+		beats:     make(map[int]time.Time),
+		processed: make(map[int]time.Time),
+		readyAfter: time.Duration(s.DustDevil.HealthReadyAfter) *
+			time.Second,
+		liveAfter: time.Duration(s.DustDevil.HealthLiveAfter) *
+			time.Second,
+		postWindow: time.Duration(s.DustDevil.HealthPostWindow) *
+			time.Second,
+	}
+	for i := 0; i < handlers; i++ {
+		h.loops[i] = now
+		h.beats[i] = now
+		h.processed[i] = now
+	}
+	return h
+}
+
+// ConfigureHealth sets the Health used by Dispatch
+func ConfigureHealth(h *Health) {
+	health = h
+}
+
+// Tick records that the main loop is making progress
+func (h *Health) Tick() {
+	h.lock.Lock()
+	h.mainTick = time.Now()
+	h.lock.Unlock()
+}
+
+// consumerStarted records that the consumer was started. erebos
+// does not report joining the consumer group or partition
+// assignments, but a consumer that fails to join reports the error
+// and returns. The consumer is considered joined while it runs.
+func (h *Health) consumerStarted() {
+	h.lock.Lock()
+	h.consumer = true
+	h.lock.Unlock()
+}
+
+// consumerStopped records that the consumer returned or was paused
+func (h *Health) consumerStopped() {
+	h.lock.Lock()
+	h.consumer = false
+	h.lock.Unlock()
+}
+
+// loop records that the event loop of handler num is running
+func (h *Health) loop(num int) {
+	h.lock.Lock()
+	h.loops[num] = time.Now()
+	h.lock.Unlock()
+}
+
+// beat records that handler num processed a heartbeat
+func (h *Health) beat(num int) {
+	h.lock.Lock()
+	h.beats[num] = time.Now()
+	h.lock.Unlock()
+}
+
+// process records that handler num processed a message
+func (h *Health) process(num int) {
+	h.lock.Lock()
+	h.processed[num] = time.Now()
+	h.lock.Unlock()
+}
+
+// activity returns when handler num last processed a heartbeat and
+// a message
+func (h *Health) activity(num int) (time.Time, time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.beats[num], h.processed[num]
+}
+
+// posted records the outcome of a POST request
+func (h *Health) posted(ok bool) {
+	h.lock.Lock()
+	if ok {
+		h.lastSuccess = time.Now()
+	} else {
+		h.lastFailure = time.Now()
+	}
+	h.lock.Unlock()
+}
+
+// Live returns the reasons DustDevil is not alive, if any
+func (h *Health) Live() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+	problems := []string{}
+	if now.Sub(h.mainTick) > h.liveAfter {
+		problems = append(problems, fmt.Sprintf(
+			"main loop stalled for %s", now.Sub(h.mainTick)))
+	}
+	problems = append(problems, h.stale(now, h.loops, `event loop`,
+		h.liveAfter)...)
+	return problems
+}
+
+// Ready returns the reasons DustDevil is not ready, if any
+func (h *Health) Ready() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+	problems := []string{}
+	if !h.consumer {
+		problems = append(problems, `consumer is not running`)
+	}
+	problems = append(problems, h.stale(now, h.beats, `heartbeat`,
+		h.readyAfter)...)
+	if h.lastFailure.After(h.lastSuccess) &&
+		now.Sub(h.lastSuccess) > h.postWindow {
+		problems = append(problems, fmt.Sprintf(
+			"no successful POST since %s",
+			h.lastSuccess.Format(time.RFC3339)))
+	}
+	return problems
+}
+
+// stale returns a problem for every handler whose last activity in
+// times is older than max
+func (h *Health) stale(now time.Time, times map[int]time.Time, activity string, max time.Duration) []string {
+	nums := make([]int, 0, len(times))
+	for num := range times {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	problems := []string{}
+	for _, num := range nums {
+		if now.Sub(times[num]) > max {
+			problems = append(problems, fmt.Sprintf(
+				"handler %d without %s for %s", num, activity,
+				now.Sub(times[num])))
+		}
+	}
+	return problems
+}
+
+// LiveHandler returns the http.Handler for /healthz
+func (h *Health) LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond(w, h.Live())
+	})
+}
+
+// ReadyHandler returns the http.Handler for /readyz
+func (h *Health) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond(w, h.Ready())
+	})
+}
+
+// respond writes the result of a health check
+func respond(w http.ResponseWriter, problems []string) {
+	w.Header().Set(`Content-Type`, `text/plain; charset=utf-8`)
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	fmt.Fprintln(w, `ok`)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,63 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthReady(t *testing.T) {
+	h := NewHealth(testSettings(t, ``), 1)
+	if !hasProblem(h.Ready(), `consumer is not running`) {
+		t.Errorf("Ready before the consumer started: %v", h.Ready())
+	}
+
+	h.consumerStarted()
+	if p := h.Ready(); len(p) != 0 {
+		t.Errorf("Not ready with a running consumer: %v", p)
+	}
+
+	h.consumerStopped()
+	if !hasProblem(h.Ready(), `consumer is not running`) {
+		t.Errorf("Ready after the consumer stopped: %v", h.Ready())
+	}
+}
+
+// TestHealthLive checks that a handler whose event loop is blocked is
+// not alive, even if it still receives heartbeats
+func TestHealthLive(t *testing.T) {
+	h := NewHealth(testSettings(t, ``), 2)
+	past := time.Now().Add(-2 * h.liveAfter)
+	h.loops[0] = past
+	h.loops[1] = past
+	h.beat(0)
+	h.loop(1)
+
+	p := h.Live()
+	if !hasProblem(p, `handler 0 without event loop`) {
+		t.Errorf("Blocked handler 0 is alive: %v", p)
+	}
+	if hasProblem(p, `handler 1`) {
+		t.Errorf("Running handler 1 is not alive: %v", p)
+	}
+}
+
+// hasProblem returns true if one of problems starts with prefix
+func hasProblem(problems []string, prefix string) bool {
+	for _, p := range problems {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
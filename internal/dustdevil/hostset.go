@@ -0,0 +1,74 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// hostSet is a set of host IDs and host ID ranges
+type hostSet struct {
+	ids    map[int]struct{}
+	ranges [][2]int
+}
+
+// parseHostSet parses a comma separated list of host IDs and host ID
+// ranges, ie. 5,10-20
+func parseHostSet(list string) (*hostSet, error) {
+	h := &hostSet{
+		ids:    make(map[int]struct{}),
+		ranges: make([][2]int, 0),
+	}
+
+	for _, elem := range strings.Split(list, `,`) {
+		if elem = strings.TrimSpace(elem); elem == `` {
+			continue
+		}
+		bounds := strings.SplitN(elem, `-`, 2)
+		lower, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, err
+		}
+		if len(bounds) == 1 {
+			h.ids[lower] = struct{}{}
+			continue
+		}
+		upper, err := strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return nil, err
+		}
+		if upper < lower {
+			return nil, fmt.Errorf("Inverted host range: %s", elem)
+		}
+		h.ranges = append(h.ranges, [2]int{lower, upper})
+	}
+	return h, nil
+}
+
+// empty returns true if the set contains no host IDs
+func (h *hostSet) empty() bool {
+	return len(h.ids) == 0 && len(h.ranges) == 0
+}
+
+// contains returns true if hostID is part of the set
+func (h *hostSet) contains(hostID int) bool {
+	if _, ok := h.ids[hostID]; ok {
+		return true
+	}
+	for _, rng := range h.ranges {
+		if hostID >= rng[0] && hostID <= rng[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
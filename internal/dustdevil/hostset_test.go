@@ -0,0 +1,64 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import "testing"
+
+func TestParseHostSet(t *testing.T) {
+	tests := []struct {
+		list     string
+		valid    bool
+		empty    bool
+		included []int
+		excluded []int
+	}{
+		{list: ``, valid: true, empty: true, excluded: []int{0, 1}},
+		{list: ` , ,`, valid: true, empty: true},
+		{list: `5`, valid: true, included: []int{5},
+			excluded: []int{4, 6}},
+		{list: `5,10-20`, valid: true, included: []int{5, 10, 15, 20},
+			excluded: []int{6, 9, 21}},
+		{list: ` 1 , 3 - 4 `, valid: true, included: []int{1, 3, 4},
+			excluded: []int{2, 5}},
+		{list: `10-10`, valid: true, included: []int{10},
+			excluded: []int{9, 11}},
+		{list: `20-10`, valid: false},
+		{list: `a`, valid: false},
+		{list: `1-`, valid: false},
+		{list: `-5`, valid: false},
+		{list: `1-b`, valid: false},
+	}
+
+	for _, tc := range tests {
+		h, err := parseHostSet(tc.list)
+		if (err == nil) != tc.valid {
+			t.Errorf("%q: valid=%t, error: %v", tc.list, tc.valid, err)
+			continue
+		}
+		if !tc.valid {
+			continue
+		}
+		if h.empty() != tc.empty {
+			t.Errorf("%q: empty=%t, expected %t", tc.list, h.empty(),
+				tc.empty)
+		}
+		for _, id := range tc.included {
+			if !h.contains(id) {
+				t.Errorf("%q does not contain %d", tc.list, id)
+			}
+		}
+		for _, id := range tc.excluded {
+			if h.contains(id) {
+				t.Errorf("%q contains %d", tc.list, id)
+			}
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
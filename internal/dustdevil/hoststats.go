@@ -0,0 +1,197 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// HostStats keeps delivery statistics for a bounded number of
+// hosts. It is shared by all handlers.
+type HostStats struct {
+	lock      sync.Mutex
+	hosts     map[int]*HostStat
+	max       int
+	published []string
+}
+
+// HostStat are the delivery statistics of a single host
+type HostStat struct {
+	HostID int `json:"hostID"`
+	// newest metric timestamp received from the host
+	LastTS time.Time `json:"last.ts"`
+	// time the last message of the host was received
+	LastSeen time.Time `json:"last.seen"`
+	// time metrics of the host were last forwarded
+	LastForwarded time.Time `json:"last.forwarded"`
+	Messages      int64     `json:"messages"`
+	Metrics       int64     `json:"metrics"`
+	Forwarded     int64     `json:"forwarded"`
+	Errors        int64     `json:"errors"`
+	Dropped       int64     `json:"dropped"`
+	Stripped      int64     `json:"stripped"`
+	// timestamps outside of the acceptance window
+	Skewed int64 `json:"timestamp.out.of.range"`
+}
+
+// NewHostStats returns HostStats for at most hoststats.max.hosts
+// hosts. If more hosts are seen, the host seen least recently is
+// evicted.
+func NewHostStats(s *Settings) *HostStats {
+	return &HostStats{
+		hosts: make(map[int]*HostStat),
+		max:   s.DustDevil.HostStatsMaxHosts,
+	}
+}
+
+// get returns the statistics of hostID, which are created if
+// required. The lock must be held.
+func (s *HostStats) get(hostID int) *HostStat {
+	if st, ok := s.hosts[hostID]; ok {
+		return st
+	}
+	if len(s.hosts) >= s.max {
+		var oldest *HostStat
+		for _, st := range s.hosts {
+			if oldest == nil || st.LastSeen.Before(oldest.LastSeen) {
+				oldest = st
+			}
+		}
+		delete(s.hosts, oldest.HostID)
+	}
+	st := &HostStat{HostID: hostID}
+	s.hosts[hostID] = st
+	return st
+}
+
+// received records a message of hostID with n metrics, the newest
+// of them from ts
+func (s *HostStats) received(hostID, n int, ts time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st := s.get(hostID)
+	st.LastSeen = time.Now()
+	st.Messages++
+	st.Metrics += int64(n)
+	if ts.After(st.LastTS) {
+		st.LastTS = ts
+	}
+}
+
+// forwarded records n forwarded metrics of hostID
+func (s *HostStats) forwarded(hostID, n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st := s.get(hostID)
+	st.LastForwarded = time.Now()
+	st.Forwarded += int64(n)
+}
+
+// failed records a failed delivery for hostID
+func (s *HostStats) failed(hostID int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.get(hostID).Errors++
+}
+
+// skewed records a timestamp of hostID outside of the acceptance
+// window
+func (s *HostStats) skewed(hostID int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.get(hostID).Skewed++
+}
+
+// dropped records n dropped and m stripped metrics of hostID
+func (s *HostStats) dropped(hostID, n, m int) {
+	if n == 0 && m == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st := s.get(hostID)
+	st.Dropped += int64(n)
+	st.Stripped += int64(m)
+}
+
+// Lookup returns a copy of the statistics of hostID
+func (s *HostStats) Lookup(hostID int) (HostStat, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, ok := s.hosts[hostID]
+	if !ok {
+		return HostStat{}, false
+	}
+	return *st, true
+}
+
+// Top returns a copy of the statistics of the n hosts with the most
+// received metrics, or of all hosts ordered by hostID if n is 0
+func (s *HostStats) Top(n int) []HostStat {
+	s.lock.Lock()
+	list := make([]HostStat, 0, len(s.hosts))
+	for _, st := range s.hosts {
+		list = append(list, *st)
+	}
+	s.lock.Unlock()
+
+	if n == 0 {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].HostID < list[j].HostID
+		})
+		return list
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Metrics != list[j].Metrics {
+			return list[i].Metrics > list[j].Metrics
+		}
+		return list[i].HostID < list[j].HostID
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// Publish registers gauges with the statistics of the top n hosts
+// in registry, replacing the previously published hosts
+func (s *HostStats) Publish(registry metrics.Registry, n int) {
+	top := s.Top(n)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, name := range s.published {
+		registry.Unregister(name)
+	}
+	s.published = make([]string, 0, 4*len(top))
+
+	for _, st := range top {
+		for name, value := range map[string]int64{
+			`metrics`:   st.Metrics,
+			`forwarded`: st.Forwarded,
+			`errors`:    st.Errors,
+			`dropped`:   st.Dropped + st.Stripped,
+		} {
+			name = fmt.Sprintf("/host/%d/%s", st.HostID, name)
+			metrics.GetOrRegisterGauge(name, registry).Update(value)
+			s.published = append(s.published, name)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
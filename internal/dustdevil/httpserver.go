@@ -0,0 +1,58 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"net/http"
+	"time"
+)
+
+// HTTPServer is the optional HTTP listener serving DustDevil's own
+// telemetry
+type HTTPServer struct {
+	Shutdown chan struct{}
+	Errors   chan error
+	mux      *http.ServeMux
+	server   *http.Server
+}
+
+// NewHTTPServer returns an HTTPServer listening on addr
+func NewHTTPServer(addr string) *HTTPServer {
+	s := &HTTPServer{
+		Shutdown: make(chan struct{}),
+		Errors:   make(chan error, 1),
+		mux:      http.NewServeMux(),
+	}
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// Handle registers handler for pattern
+func (s *HTTPServer) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Run serves HTTP requests until Shutdown is closed
+func (s *HTTPServer) Run() {
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil &&
+			err != http.ErrServerClosed {
+			s.Errors <- err
+		}
+	}()
+
+	<-s.Shutdown
+	s.server.Close()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,73 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+)
+
+// Error is an error that carries structured log fields describing
+// where it occurred
+type Error struct {
+	Err    error
+	Fields logrus.Fields
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// ErrorFields returns the log fields of err, which are empty if err
+// does not carry any
+func ErrorFields(err error) logrus.Fields {
+	if e, ok := err.(*Error); ok {
+		return e.Fields
+	}
+	return logrus.Fields{}
+}
+
+// withFields returns err with fields added to its log fields. Fields
+// already set on err are kept.
+func withFields(err error, fields logrus.Fields) error {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Err: err, Fields: logrus.Fields{}}
+	}
+	for k, v := range fields {
+		if _, ok := e.Fields[k]; !ok {
+			e.Fields[k] = v
+		}
+	}
+	return e
+}
+
+// fail returns err with the log fields of the handler and of msg,
+// which may be nil
+func (d *DustDevil) fail(err error, msg *erebos.Transport) error {
+	return withFields(err, d.msgFields(msg))
+}
+
+// msgFields returns the log fields of the handler and of msg, which
+// may be nil
+func (d *DustDevil) msgFields(msg *erebos.Transport) logrus.Fields {
+	fields := logrus.Fields{
+		`handler`: d.Num,
+	}
+	if msg != nil {
+		fields[`hostID`] = msg.HostID
+		fields[`topic`] = msg.Topic
+		fields[`partition`] = msg.Partition
+		fields[`offset`] = msg.Offset
+	}
+	return fields
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
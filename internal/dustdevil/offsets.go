@@ -0,0 +1,149 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// offsets is the offset tracker shared by all handlers, since the
+// messages of a partition are spread across handlers by hostID
+var offsets = newOffsetTracker()
+
+// partitionKey identifies a topic partition
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+// offsetTracker records the consumed, processed and committed
+// offsets per topic partition
+type offsetTracker struct {
+	lock       sync.Mutex
+	partitions map[partitionKey]*partitionState
+}
+
+// partitionState is the offset state of a partition
+type partitionState struct {
+	// highest offset consumed from the partition
+	consumed int64
+	// highest offset received by a handler
+	processed int64
+	// consumed offsets that are not committed yet
+	inflight map[int64]struct{}
+	// offsets of inflight, the lowest one first. Committed offsets
+	// are only removed once they are the lowest one.
+	pending offsetHeap
+}
+
+// partitionOffsets is the offset state of a partition
+type partitionOffsets struct {
+	// highest offset received by a handler
+	processed int64
+	// offset up to which all consumed messages are committed
+	committed int64
+	// number of consumed messages that are not committed
+	lag int64
+}
+
+// offsetHeap is a min-heap of offsets, implementing heap.Interface
+type offsetHeap []int64
+
+func (h offsetHeap) Len() int            { return len(h) }
+func (h offsetHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h offsetHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *offsetHeap) Push(x interface{}) { *h = append(*h, x.(int64)) }
+
+func (h *offsetHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// newOffsetTracker returns an empty offsetTracker
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		partitions: make(map[partitionKey]*partitionState),
+	}
+}
+
+// partition returns the state of partition key, which is created if
+// required. The lock must be held.
+func (t *offsetTracker) partition(key partitionKey) *partitionState {
+	p, ok := t.partitions[key]
+	if !ok {
+		p = &partitionState{
+			inflight: make(map[int64]struct{}),
+			pending:  make(offsetHeap, 0),
+		}
+		t.partitions[key] = p
+	}
+	return p
+}
+
+// consume records offset as consumed from a partition
+func (t *offsetTracker) consume(key partitionKey, offset int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p := t.partition(key)
+	if _, ok := p.inflight[offset]; !ok {
+		p.inflight[offset] = struct{}{}
+		heap.Push(&p.pending, offset)
+	}
+	if offset > p.consumed {
+		p.consumed = offset
+	}
+}
+
+// process records offset as processed and returns the offsets of the
+// partition
+func (t *offsetTracker) process(key partitionKey, offset int64) partitionOffsets {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p := t.partition(key)
+	if offset > p.processed {
+		p.processed = offset
+	}
+	return p.offsets()
+}
+
+// commit records offset as committed and returns the offsets of the
+// partition
+func (t *offsetTracker) commit(key partitionKey, offset int64) partitionOffsets {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p := t.partition(key)
+	delete(p.inflight, offset)
+	for p.pending.Len() > 0 {
+		if _, ok := p.inflight[p.pending[0]]; ok {
+			break
+		}
+		heap.Pop(&p.pending)
+	}
+	return p.offsets()
+}
+
+// offsets returns the offsets of p. Messages are committed out of
+// order, the committed offset is the one below the oldest consumed
+// message that is not committed yet.
+func (p *partitionState) offsets() partitionOffsets {
+	committed := p.consumed
+	if p.pending.Len() > 0 {
+		committed = p.pending[0] - 1
+	}
+	return partitionOffsets{
+		processed: p.processed,
+		committed: committed,
+		lag:       p.consumed - committed,
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
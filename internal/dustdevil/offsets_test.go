@@ -0,0 +1,53 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import "testing"
+
+func TestOffsetTracker(t *testing.T) {
+	key := partitionKey{topic: `metrics`, partition: 3}
+	tr := newOffsetTracker()
+	for offset := int64(10); offset <= 14; offset++ {
+		tr.consume(key, offset)
+	}
+
+	tests := []struct {
+		// offset that is committed
+		commit    int64
+		committed int64
+		lag       int64
+	}{
+		{commit: 12, committed: 9, lag: 5},
+		{commit: 10, committed: 10, lag: 4},
+		{commit: 11, committed: 12, lag: 2},
+		// committing twice does not move the offset
+		{commit: 11, committed: 12, lag: 2},
+		{commit: 14, committed: 12, lag: 2},
+		{commit: 13, committed: 14, lag: 0},
+	}
+
+	for _, tc := range tests {
+		o := tr.commit(key, tc.commit)
+		if o.committed != tc.committed || o.lag != tc.lag {
+			t.Errorf("Commit %d: committed=%d lag=%d, expected %d/%d",
+				tc.commit, o.committed, o.lag, tc.committed, tc.lag)
+		}
+	}
+
+	if o := tr.process(key, 14); o.processed != 14 {
+		t.Errorf("Processed offset %d, expected 14", o.processed)
+	}
+	other := tr.process(partitionKey{topic: `metrics`}, 1)
+	if other.committed != 0 || other.lag != 0 {
+		t.Errorf("Unrelated partition: committed=%d lag=%d",
+			other.committed, other.lag)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,150 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+)
+
+// Pool is the set of equivalent API endpoints that requests without
+// a route are balanced across. It is shared by all handlers.
+type Pool struct {
+	endpoints []*endpoint
+	balance   string
+	threshold int
+	cooldown  time.Duration
+	next      uint32
+}
+
+// endpoint is a member of Pool with its passive health state
+type endpoint struct {
+	url string
+	// position in the configured endpoint list
+	num      int
+	inflight int32
+	lock     sync.Mutex
+	failures int
+	ejected  time.Time
+}
+
+// NewPool returns the endpoint pool configured in conf and s. If no
+// endpoint list is configured, the pool consists of the single
+// api.endpoint.
+func NewPool(conf *erebos.Config, s *Settings) *Pool {
+	p := &Pool{
+		endpoints: make([]*endpoint, 0),
+		balance:   s.DustDevil.Balance,
+		threshold: s.DustDevil.EjectThreshold,
+		cooldown: time.Duration(s.DustDevil.EjectCooldown) *
+			time.Millisecond,
+	}
+
+	urls := s.DustDevil.Endpoints
+	if len(urls) == 0 {
+		urls = []string{conf.DustDevil.Endpoint}
+	}
+	for i, url := range urls {
+		p.endpoints = append(p.endpoints, &endpoint{url: url, num: i})
+	}
+	return p
+}
+
+// Len returns the number of endpoints in the pool
+func (p *Pool) Len() int {
+	return len(p.endpoints)
+}
+
+// pick selects the endpoint for a request of hostID. Endpoints in
+// tried are skipped, ejected endpoints are only used if no healthy
+// endpoint is left.
+func (p *Pool) pick(hostID int, tried map[*endpoint]bool) *endpoint {
+	now := time.Now()
+	candidates := make([]*endpoint, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		if !tried[e] && e.healthy(now) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, e := range p.endpoints {
+			if !tried[e] {
+				candidates = append(candidates, e)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.endpoints
+	}
+
+	switch p.balance {
+	case `least-inflight`:
+		least := candidates[0]
+		for _, e := range candidates[1:] {
+			if atomic.LoadInt32(&e.inflight) <
+				atomic.LoadInt32(&least.inflight) {
+				least = e
+			}
+		}
+		return least
+	case `hash`:
+		// start at the hostID's endpoint and fail over to the next
+		// candidate in pool order. hostID is taken as unsigned, so
+		// that negative IDs map to an endpoint as well.
+		start := int(uint(hostID) % uint(len(p.endpoints)))
+		for i := 0; i < len(p.endpoints); i++ {
+			e := p.endpoints[(start+i)%len(p.endpoints)]
+			for _, c := range candidates {
+				if c == e {
+					return e
+				}
+			}
+		}
+		return candidates[0]
+	default:
+		n := atomic.AddUint32(&p.next, 1)
+		return candidates[n%uint32(len(candidates))]
+	}
+}
+
+// success records a successful request to e
+func (p *Pool) success(e *endpoint) {
+	e.lock.Lock()
+	e.failures = 0
+	e.lock.Unlock()
+}
+
+// failure records a failed request to e and ejects e from the pool
+// for the cooldown period once the failure threshold is reached
+func (p *Pool) failure(e *endpoint) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.failures++
+	if e.failures < p.threshold {
+		return
+	}
+	e.failures = 0
+	e.ejected = time.Now().Add(p.cooldown)
+	logrus.WithField(`endpoint`, e.url).Warnf(
+		"Ejecting endpoint %s for %s", e.url, p.cooldown)
+}
+
+// healthy returns true if e is not ejected at time now
+func (e *endpoint) healthy(now time.Time) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return !now.Before(e.ejected)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
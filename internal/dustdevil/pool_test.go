@@ -0,0 +1,323 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// newTestPool returns a pool of the endpoints a, b and c with the
+// settings options
+func newTestPool(t *testing.T, options string) *Pool {
+	t.Helper()
+	s := &Settings{}
+	if err := s.fromJSON([]byte(`{"dustdevil":{` +
+		`"api.endpoints":["a","b","c"]` + options + `}}`)); err != nil {
+		t.Fatal(err)
+	}
+	return NewPool(&erebos.Config{}, s)
+}
+
+// picks returns the URLs of n endpoints picked for hostID
+func picks(p *Pool, hostID, n int) []string {
+	urls := []string{}
+	for i := 0; i < n; i++ {
+		urls = append(urls, p.pick(hostID, nil).url)
+	}
+	return urls
+}
+
+func TestNewPool(t *testing.T) {
+	conf := &erebos.Config{}
+	conf.DustDevil.Endpoint = `single`
+
+	single := NewPool(conf, &Settings{})
+	if single.Len() != 1 || single.endpoints[0].url != `single` {
+		t.Errorf("Pool without api.endpoints: %d endpoints",
+			single.Len())
+	}
+	if p := newTestPool(t, ``); p.Len() != 3 {
+		t.Errorf("Pool of api.endpoints has %d endpoints", p.Len())
+	}
+}
+
+func TestPoolPick(t *testing.T) {
+	tests := []struct {
+		balance string
+		hostID  int
+		// ejected endpoints by index
+		ejected []int
+		// endpoints by index used in flight
+		inflight []int
+		// every picked endpoint must be one of
+		allowed map[string]bool
+		// number of different endpoints picked in 6 requests
+		distinct int
+	}{
+		{balance: `round-robin`,
+			allowed:  map[string]bool{`a`: true, `b`: true, `c`: true},
+			distinct: 3},
+		{balance: `round-robin`, ejected: []int{1},
+			allowed:  map[string]bool{`a`: true, `c`: true},
+			distinct: 2},
+		{balance: `round-robin`, ejected: []int{0, 1, 2},
+			allowed:  map[string]bool{`a`: true, `b`: true, `c`: true},
+			distinct: 3},
+		{balance: `hash`, hostID: 4,
+			allowed:  map[string]bool{`b`: true},
+			distinct: 1},
+		{balance: `hash`, hostID: 4, ejected: []int{1},
+			allowed:  map[string]bool{`c`: true},
+			distinct: 1},
+		{balance: `hash`, hostID: 5, ejected: []int{2},
+			allowed:  map[string]bool{`a`: true},
+			distinct: 1},
+		{balance: `hash`, hostID: -1,
+			allowed:  map[string]bool{`a`: true},
+			distinct: 1},
+		{balance: `least-inflight`, inflight: []int{0, 2},
+			allowed:  map[string]bool{`b`: true},
+			distinct: 1},
+		{balance: `least-inflight`, inflight: []int{0},
+			ejected:  []int{1},
+			allowed:  map[string]bool{`c`: true},
+			distinct: 1},
+	}
+
+	for _, tc := range tests {
+		p := newTestPool(t,
+			`,"api.endpoints.balance":"`+tc.balance+`"`)
+		for _, i := range tc.ejected {
+			p.endpoints[i].ejected = time.Now().Add(time.Minute)
+		}
+		for _, i := range tc.inflight {
+			p.endpoints[i].inflight = 1
+		}
+
+		seen := map[string]bool{}
+		for _, url := range picks(p, tc.hostID, 6) {
+			if !tc.allowed[url] {
+				t.Errorf("%s ejected=%v inflight=%v: picked %s",
+					tc.balance, tc.ejected, tc.inflight, url)
+			}
+			seen[url] = true
+		}
+		if len(seen) != tc.distinct {
+			t.Errorf("%s ejected=%v inflight=%v: picked %d"+
+				" endpoints, expected %d", tc.balance, tc.ejected,
+				tc.inflight, len(seen), tc.distinct)
+		}
+	}
+}
+
+func TestBalanceSetting(t *testing.T) {
+	tests := []struct {
+		balance string
+		valid   bool
+	}{
+		{balance: ``, valid: true},
+		{balance: `round-robin`, valid: true},
+		{balance: `least-inflight`, valid: true},
+		{balance: `hash`, valid: true},
+		{balance: `random`, valid: false},
+	}
+
+	for _, tc := range tests {
+		s := &Settings{}
+		err := s.fromJSON([]byte(`{"dustdevil":` +
+			`{"api.endpoints.balance":"` + tc.balance + `"}}`))
+		if (err == nil) != tc.valid {
+			t.Errorf("api.endpoints.balance %q: valid=%t, error: %v",
+				tc.balance, tc.valid, err)
+		}
+	}
+}
+
+func TestPoolPickSkipsTried(t *testing.T) {
+	p := newTestPool(t, `,"api.endpoints.balance":"hash"`)
+	tried := map[*endpoint]bool{}
+	for _, expected := range []string{`b`, `c`, `a`} {
+		e := p.pick(1, tried)
+		if e.url != expected {
+			t.Errorf("Picked %s, expected %s", e.url, expected)
+		}
+		tried[e] = true
+	}
+}
+
+func TestPoolEjection(t *testing.T) {
+	p := newTestPool(t, `,"api.endpoints.eject.threshold":"2",`+
+		`"api.endpoints.eject.cooldown.ms":"50"`)
+	e := p.endpoints[0]
+
+	tests := []struct {
+		event   string
+		healthy bool
+	}{
+		{event: `failure`, healthy: true},
+		{event: `success`, healthy: true},
+		{event: `failure`, healthy: true},
+		{event: `failure`, healthy: false},
+		{event: `cooldown`, healthy: true},
+		{event: `failure`, healthy: true},
+	}
+
+	for i, tc := range tests {
+		switch tc.event {
+		case `failure`:
+			p.failure(e)
+		case `success`:
+			p.success(e)
+		case `cooldown`:
+			time.Sleep(60 * time.Millisecond)
+		}
+		if h := e.healthy(time.Now()); h != tc.healthy {
+			t.Errorf("Step %d %s: healthy=%t, expected %t", i,
+				tc.event, h, tc.healthy)
+		}
+	}
+}
+
+func TestPostFailover(t *testing.T) {
+	failing := newTestSink(t, http.StatusInternalServerError)
+	working := newTestSink(t, http.StatusOK)
+
+	d := newTestHandler(t, `batch`, false, ``,
+		`"api.endpoints":["`+failing.URL+`","`+working.URL+`"],`+
+			`"api.endpoints.balance":"hash"`)
+	d.Config.DustDevil.RetryCount = 2
+
+	// hostID 0 hashes to the failing endpoint first
+	resp, err := d.post(&request{hostID: 0, body: []byte(`{}`)})
+	if err != nil || resp.StatusCode() != http.StatusOK {
+		t.Fatalf("POST was not failed over: %v", err)
+	}
+	if len(failing.posts()) != 1 || len(working.posts()) != 1 {
+		t.Errorf("Requests to failing/working endpoint: %d/%d,"+
+			" expected 1/1", len(failing.posts()),
+			len(working.posts()))
+	}
+	if n := metrics.GetOrRegisterCounter(`/output/retries`,
+		*d.Metrics).Count(); n != 1 {
+		t.Errorf("Counted %d retries, expected 1", n)
+	}
+}
+
+func TestPostRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		endpoints string
+		routed    bool
+		failures  int
+		retries   int
+		ok        bool
+	}{
+		{name: `single endpoint`, failures: 2, retries: 2, ok: true},
+		{name: `single endpoint exhausted`, failures: 3, retries: 2,
+			ok: false},
+		{name: `routed with pool`, endpoints: `"api.endpoints":` +
+			`["http://127.0.0.1:1","http://127.0.0.1:2"]`,
+			routed: true, failures: 2, retries: 2, ok: true},
+		{name: `routed without pool`, routed: true, failures: 1,
+			retries: 1, ok: true},
+	}
+
+	for _, tc := range tests {
+		sink := newTestSink(t, http.StatusOK)
+		sink.failNext(tc.failures)
+
+		d := newTestHandler(t, `batch`, false, sink.URL, tc.endpoints)
+		d.Config.DustDevil.RetryCount = 2
+
+		req := &request{hostID: 1, body: []byte(`{}`)}
+		if tc.routed {
+			req.endpoint = sink.URL
+		}
+		resp, err := d.post(req)
+		ok := err == nil && resp.StatusCode() == http.StatusOK
+		if ok != tc.ok {
+			t.Errorf("%s: success=%t, expected %t (%v)", tc.name, ok,
+				tc.ok, err)
+		}
+		if n := metrics.GetOrRegisterCounter(`/output/retries`,
+			*d.Metrics).Count(); n != int64(tc.retries) {
+			t.Errorf("%s: counted %d retries, expected %d", tc.name,
+				n, tc.retries)
+		}
+	}
+}
+
+// TestSinkTimers checks that latency timers are kept per route and
+// pool endpoint, not per URL of a templated route
+func TestSinkTimers(t *testing.T) {
+	sink := newTestSink(t, http.StatusOK)
+	d := newTestHandler(t, `batch`, false, sink.URL, ``)
+
+	for hostID := 1; hostID <= 3; hostID++ {
+		if _, err := d.post(&request{
+			hostID:   hostID,
+			endpoint: fmt.Sprintf("%s/host/%d", sink.URL, hostID),
+			route:    `perhost`,
+			body:     []byte(`{}`),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.post(&request{hostID: 1,
+		body: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	timers := map[string]int64{}
+	(*d.Metrics).Each(func(name string, v interface{}) {
+		if timer, ok := v.(metrics.Timer); ok {
+			timers[name] = timer.Count()
+		}
+	})
+	expected := map[string]int64{
+		`/output/sink/route/perhost/2xx/latency`: 3,
+		`/output/sink/pool/0/2xx/latency`:        1,
+	}
+	if !reflect.DeepEqual(timers, expected) {
+		t.Errorf("Timers %v, expected %v", timers, expected)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := newTestHandler(t, `batch`, false, ``, ``)
+	d.Config.DustDevil.RetryMinWaitTime = 100
+	d.Config.DustDevil.RetryMaxWaitTime = 500
+
+	tests := []struct {
+		attempt int
+		wait    time.Duration
+	}{
+		{attempt: 1, wait: 100 * time.Millisecond},
+		{attempt: 2, wait: 200 * time.Millisecond},
+		{attempt: 3, wait: 400 * time.Millisecond},
+		{attempt: 4, wait: 500 * time.Millisecond},
+		{attempt: 10, wait: 500 * time.Millisecond},
+	}
+
+	for _, tc := range tests {
+		if wait := d.backoff(tc.attempt); wait != tc.wait {
+			t.Errorf("backoff(%d) = %s, expected %s", tc.attempt,
+				wait, tc.wait)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
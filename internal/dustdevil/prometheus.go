@@ -0,0 +1,203 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// quantiles exported for histograms and timers
+var quantiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+
+// labelEscaper escapes label values as required by the text
+// exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`,
+	"\n", `\n`)
+
+// Prometheus exports a metrics registry in the Prometheus text
+// exposition format, implementing http.Handler
+type Prometheus struct {
+	registry metrics.Registry
+	prefix   string
+	labels   string
+}
+
+// NewPrometheus returns a Prometheus exporter for registry. The
+// registry prefix is removed from all metric names, the instance
+// name is exported as label instead.
+func NewPrometheus(registry metrics.Registry, prefix, instance string) *Prometheus {
+	p := &Prometheus{
+		registry: registry,
+		prefix:   prefix,
+	}
+	if instance != `` {
+		p.labels = `instance_name="` + labelEscaper.Replace(instance) +
+			`"`
+	}
+	return p
+}
+
+// ServeHTTP writes the current state of the registry
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	p.write(buf)
+
+	w.Header().Set(`Content-Type`, `text/plain; version=0.0.4`)
+	w.Write(buf.Bytes())
+}
+
+// write writes all metrics of the registry to w, ordered by name
+func (p *Prometheus) write(w io.Writer) {
+	values := make(map[string]interface{})
+	p.registry.Each(func(name string, v interface{}) {
+		values[name] = v
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	used := make(map[string]bool)
+	for _, name := range names {
+		family := unique(p.family(name), values[name], used)
+		switch v := values[name].(type) {
+		case metrics.Counter:
+			p.sample(w, family+`_total`, `counter`,
+				float64(v.Count()))
+		case metrics.Gauge:
+			p.sample(w, family, `gauge`, float64(v.Value()))
+		case metrics.GaugeFloat64:
+			p.sample(w, family, `gauge`, v.Value())
+		case metrics.Meter:
+			m := v.Snapshot()
+			p.sample(w, family+`_total`, `counter`,
+				float64(m.Count()))
+			p.sample(w, family+`_rate1m`, `gauge`, m.Rate1())
+			p.sample(w, family+`_rate5m`, `gauge`, m.Rate5())
+			p.sample(w, family+`_rate15m`, `gauge`, m.Rate15())
+		case metrics.Histogram:
+			h := v.Snapshot()
+			p.summary(w, family, h.Percentiles(quantiles), 1,
+				float64(h.Sum()), h.Count())
+		case metrics.Timer:
+			// timers record nanoseconds, exported as seconds
+			t := v.Snapshot()
+			p.summary(w, family+`_seconds`, t.Percentiles(quantiles),
+				float64(time.Second), float64(t.Sum()), t.Count())
+		}
+	}
+}
+
+// family returns the Prometheus metric name for the registry metric
+// name
+func (p *Prometheus) family(name string) string {
+	name = strings.TrimPrefix(name, p.prefix)
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	return `dustdevil_` + strings.Trim(name, `_`)
+}
+
+// unique returns family, suffixed with a number if one of the
+// metric names exported for v was already used by another registry
+// metric. Registry names that only differ in replaced characters,
+// ie. /a.b and /a/b, would otherwise export the same metric twice.
+func unique(family string, v interface{}, used map[string]bool) string {
+	for i := 1; ; i++ {
+		candidate := family
+		if i > 1 {
+			candidate = fmt.Sprintf("%s_%d", family, i)
+		}
+		exported := exportedNames(candidate, v)
+		free := true
+		for _, name := range exported {
+			if used[name] {
+				free = false
+				break
+			}
+		}
+		if free {
+			for _, name := range exported {
+				used[name] = true
+			}
+			return candidate
+		}
+	}
+}
+
+// exportedNames returns the metric names write exports for v under
+// family
+func exportedNames(family string, v interface{}) []string {
+	switch v.(type) {
+	case metrics.Counter:
+		return []string{family + `_total`}
+	case metrics.Gauge, metrics.GaugeFloat64:
+		return []string{family}
+	case metrics.Meter:
+		return []string{family + `_total`, family + `_rate1m`,
+			family + `_rate5m`, family + `_rate15m`}
+	case metrics.Histogram:
+		return []string{family, family + `_sum`, family + `_count`}
+	case metrics.Timer:
+		return []string{family + `_seconds`, family + `_seconds_sum`,
+			family + `_seconds_count`}
+	}
+	return nil
+}
+
+// sample writes a single metric with its type
+func (p *Prometheus) sample(w io.Writer, name, kind string, value float64) {
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(w, "%s%s %g\n", name, p.join(``), value)
+}
+
+// summary writes a summary with the given quantile values, which are
+// divided by scale
+func (p *Prometheus) summary(w io.Writer, name string, values []float64, scale, sum float64, count int64) {
+	fmt.Fprintf(w, "# TYPE %s summary\n", name)
+	for i, q := range quantiles {
+		fmt.Fprintf(w, "%s%s %g\n", name,
+			p.join(fmt.Sprintf("quantile=\"%g\"", q)),
+			values[i]/scale)
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, p.join(``), sum/scale)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, p.join(``), count)
+}
+
+// join returns the label set of a sample with the instance label
+func (p *Prometheus) join(labels string) string {
+	switch {
+	case labels == `` && p.labels == ``:
+		return ``
+	case labels == ``:
+		return `{` + p.labels + `}`
+	case p.labels == ``:
+		return `{` + labels + `}`
+	default:
+		return `{` + p.labels + `,` + labels + `}`
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,176 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestPrometheusFamily(t *testing.T) {
+	p := NewPrometheus(metrics.NewRegistry(), `/dustdevil/dd1`, ``)
+
+	tests := []struct {
+		name   string
+		family string
+	}{
+		{`/dustdevil/dd1/input/messages.per.second`,
+			`dustdevil_input_messages_per_second`},
+		{`/dustdevil/dd1/filter/drop-sys/dropped`,
+			`dustdevil_filter_drop_sys_dropped`},
+		{`/other/metric`, `dustdevil_other_metric`},
+		{`/dustdevil/dd1/`, `dustdevil_`},
+	}
+
+	for _, tc := range tests {
+		if family := p.family(tc.name); family != tc.family {
+			t.Errorf("family(%s) = %s, expected %s", tc.name, family,
+				tc.family)
+		}
+	}
+}
+
+func TestPrometheusJoin(t *testing.T) {
+	tests := []struct {
+		instance string
+		labels   string
+		joined   string
+	}{
+		{``, ``, ``},
+		{``, `quantile="0.5"`, `{quantile="0.5"}`},
+		{`dd1`, ``, `{instance_name="dd1"}`},
+		{`dd1`, `quantile="0.5"`,
+			`{instance_name="dd1",quantile="0.5"}`},
+		{"d\\d\"1\n√", ``, `{instance_name="d\\d\"1\n√"}`},
+	}
+
+	for _, tc := range tests {
+		p := NewPrometheus(metrics.NewRegistry(), ``, tc.instance)
+		if joined := p.join(tc.labels); joined != tc.joined {
+			t.Errorf("%q: join(%q) = %s, expected %s", tc.instance,
+				tc.labels, joined, tc.joined)
+		}
+	}
+}
+
+func TestPrometheusWrite(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter(`/dd/output/retries`,
+		registry).Inc(3)
+	metrics.GetOrRegisterGauge(`/dd/lag`, registry).Update(42)
+	metrics.GetOrRegisterGaugeFloat64(`/dd/ratio`,
+		registry).Update(0.5)
+	metrics.GetOrRegisterMeter(`/dd/input/messages`,
+		registry).Mark(7)
+	h := metrics.GetOrRegisterHistogram(`/dd/batch/size`, registry,
+		metrics.NewUniformSample(16))
+	h.Update(10)
+	h.Update(30)
+	metrics.GetOrRegisterTimer(`/dd/post`, registry).Update(
+		2 * time.Second)
+
+	p := NewPrometheus(registry, `/dd`, `dd1`)
+	buf := &bytes.Buffer{}
+	p.write(buf)
+	out := buf.String()
+
+	tests := []string{
+		"# TYPE dustdevil_output_retries_total counter\n" +
+			"dustdevil_output_retries_total{instance_name=\"dd1\"} 3\n",
+		"# TYPE dustdevil_lag gauge\n" +
+			"dustdevil_lag{instance_name=\"dd1\"} 42\n",
+		"dustdevil_ratio{instance_name=\"dd1\"} 0.5\n",
+		"dustdevil_input_messages_total{instance_name=\"dd1\"} 7\n",
+		"# TYPE dustdevil_input_messages_rate1m gauge\n",
+		"# TYPE dustdevil_input_messages_rate15m gauge\n",
+		"# TYPE dustdevil_batch_size summary\n",
+		"dustdevil_batch_size{instance_name=\"dd1\",quantile=\"0.999\"} 30\n",
+		"dustdevil_batch_size_sum{instance_name=\"dd1\"} 40\n",
+		"dustdevil_batch_size_count{instance_name=\"dd1\"} 2\n",
+		"dustdevil_post_seconds{instance_name=\"dd1\",quantile=\"0.5\"} 2\n",
+		"dustdevil_post_seconds_sum{instance_name=\"dd1\"} 2\n",
+		"dustdevil_post_seconds_count{instance_name=\"dd1\"} 1\n",
+	}
+
+	for _, expected := range tests {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Output lacks %q", expected)
+		}
+	}
+	// families are written ordered by registry name
+	if strings.Index(out, `dustdevil_batch_size`) >
+		strings.Index(out, `dustdevil_ratio`) {
+		t.Error(`Output is not ordered`)
+	}
+}
+
+// TestPrometheusCollision checks that registry names with the same
+// family are exported under distinct metric names
+func TestPrometheusCollision(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter(`/a.b`, registry).Inc(1)
+	metrics.GetOrRegisterCounter(`/a/b`, registry).Inc(2)
+	metrics.GetOrRegisterGauge(`/a_b_total`, registry).Update(3)
+	metrics.GetOrRegisterMeter(`/c`, registry).Mark(4)
+	metrics.GetOrRegisterGauge(`/c_rate5m`, registry).Update(5)
+
+	buf := &bytes.Buffer{}
+	NewPrometheus(registry, ``, ``).write(buf)
+	out := buf.String()
+
+	types := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, `# TYPE `) {
+			continue
+		}
+		name := strings.Fields(line)[2]
+		if types[name] {
+			t.Errorf("Metric %s is exported twice", name)
+		}
+		types[name] = true
+	}
+
+	for _, expected := range []string{
+		"dustdevil_a_b_total 1\n",
+		"dustdevil_a_b_2_total 2\n",
+		"dustdevil_a_b_total_2 3\n",
+		"dustdevil_c_total 4\n",
+		"dustdevil_c_rate5m_2 5\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Output lacks %q", expected)
+		}
+	}
+}
+
+func TestPrometheusServeHTTP(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter(`/requests`, registry).Inc(1)
+
+	rec := httptest.NewRecorder()
+	NewPrometheus(registry, ``, ``).ServeHTTP(rec,
+		httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+
+	if ct := rec.Header().Get(`Content-Type`); ct !=
+		`text/plain; version=0.0.4` {
+		t.Errorf("Content-Type %s", ct)
+	}
+	if body := rec.Body.String(); !strings.Contains(body,
+		"dustdevil_requests_total 1\n") {
+		t.Errorf("Body %q", body)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,111 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"sync"
+	"time"
+)
+
+// counterKey identifies the time series of a counter
+type counterKey struct {
+	hostID  int
+	path    string
+	subtype string
+}
+
+// counterSample is the last seen sample of a counter
+type counterSample struct {
+	ts    time.Time
+	value int64
+	seen  time.Time
+}
+
+// rateState tracks the last sample of every counter to derive rates
+// from consecutive samples
+type rateState struct {
+	lock    sync.Mutex
+	samples map[counterKey]counterSample
+	// counter width in bits for wrap detection, 0 disables wrap
+	// handling
+	bits uint
+	// largest increase across a wrap, larger ones are resets
+	margin uint64
+}
+
+// newRateState returns an empty rateState. Decreases of counters that
+// are bits wide are wraps if the wrapped increase is at most
+// marginPercent of the counter range.
+func newRateState(bits, marginPercent int) *rateState {
+	s := &rateState{
+		samples: make(map[counterKey]counterSample),
+		bits:    uint(bits),
+	}
+	if s.bits > 0 && s.bits < 64 {
+		s.margin = (uint64(1) << s.bits) / 100 * uint64(marginPercent)
+	}
+	return s
+}
+
+// rate records the sample value at ts for key and returns the per
+// second rate since the previous sample. No rate is returned for the
+// first sample, for samples that are not newer than the previous one
+// and after counter resets.
+func (s *rateState) rate(key counterKey, ts time.Time, value int64) (float64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prev, ok := s.samples[key]
+	if ok && !ts.After(prev.ts) {
+		// duplicate or out of order sample
+		return 0, false
+	}
+	s.samples[key] = counterSample{
+		ts:    ts,
+		value: value,
+		seen:  time.Now(),
+	}
+	if !ok {
+		return 0, false
+	}
+
+	delta := value - prev.value
+	if delta < 0 {
+		// a counter that wrapped around its maximum value continues
+		// from zero, everything else is treated as reset
+		if s.bits == 0 || s.bits >= 64 || prev.value < 0 ||
+			uint64(prev.value) >= uint64(1)<<s.bits {
+			return 0, false
+		}
+		wrapped := (uint64(1) << s.bits) - uint64(prev.value) +
+			uint64(value)
+		if value < 0 || wrapped > s.margin {
+			// too large an increase for a wrap
+			return 0, false
+		}
+		delta = int64(wrapped)
+	}
+	return float64(delta) / ts.Sub(prev.ts).Seconds(), true
+}
+
+// expire removes the state of all counters that have not been seen
+// for maxAge
+func (s *rateState) expire(maxAge time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for key, sample := range s.samples {
+		if now.Sub(sample.seen) > maxAge {
+			delete(s.samples, key)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,183 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"testing"
+	"time"
+
+	"github.com/solnx/legacy"
+)
+
+func TestRate(t *testing.T) {
+	ts := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	max32 := int64(1) << 32
+
+	tests := []struct {
+		name   string
+		bits   int
+		margin int
+		// previous sample, 10 seconds before the current sample
+		prev  int64
+		value int64
+		// offset of the current sample against its regular ts
+		offset time.Duration
+		rate   float64
+		ok     bool
+	}{
+		{name: `increase`, bits: 32, margin: 10, prev: 1000,
+			value: 1100, rate: 10, ok: true},
+		{name: `unchanged`, bits: 32, margin: 10, prev: 1000,
+			value: 1000, rate: 0, ok: true},
+		{name: `duplicate`, bits: 32, margin: 10, prev: 1000,
+			value: 1100, offset: -10 * time.Second, ok: false},
+		{name: `out of order`, bits: 32, margin: 10, prev: 1000,
+			value: 1100, offset: -20 * time.Second, ok: false},
+		{name: `wrap`, bits: 32, margin: 10, prev: max32 - 50,
+			value: 50, rate: 10, ok: true},
+		{name: `wrap at margin`, bits: 32, margin: 10,
+			prev: max32 - 50, value: max32/100*10 - 50,
+			rate: float64(max32/100*10) / 10, ok: true},
+		{name: `reset beyond margin`, bits: 32, margin: 10,
+			prev: max32 - 50, value: max32/100*10 - 49, ok: false},
+		{name: `reset to zero`, bits: 32, margin: 10,
+			prev: 1000000000, value: 0, ok: false},
+		{name: `reset with full margin`, bits: 32, margin: 100,
+			prev: 1000000000, value: 0, rate: float64(
+				max32-1000000000) / 10, ok: true},
+		{name: `previous beyond width`, bits: 32, margin: 10,
+			prev: max32 + 10, value: 5, ok: false},
+		{name: `negative previous`, bits: 32, margin: 10,
+			prev: -10, value: -20, ok: false},
+		{name: `wrap handling disabled`, bits: 0, margin: 10,
+			prev: max32 - 50, value: 50, ok: false},
+		{name: `64 bit counter`, bits: 64, margin: 10, prev: 1000,
+			value: 10, ok: false},
+	}
+
+	for _, tc := range tests {
+		s := newRateState(tc.bits, tc.margin)
+		key := counterKey{hostID: 1, path: `/net/bytes`}
+		if _, ok := s.rate(key, ts, tc.prev); ok {
+			t.Errorf("%s: rate for first sample", tc.name)
+		}
+		rate, ok := s.rate(key, ts.Add(10*time.Second+tc.offset),
+			tc.value)
+		if ok != tc.ok || (ok && rate != tc.rate) {
+			t.Errorf("%s: rate %f, %t; expected %f, %t", tc.name,
+				rate, ok, tc.rate, tc.ok)
+		}
+	}
+}
+
+func TestRateExpire(t *testing.T) {
+	s := newRateState(64, 10)
+	ts := time.Now()
+	old := counterKey{hostID: 1, path: `/old`}
+	fresh := counterKey{hostID: 1, path: `/fresh`}
+
+	s.rate(old, ts, 1)
+	s.rate(fresh, ts, 1)
+	sample := s.samples[old]
+	sample.seen = sample.seen.Add(-time.Hour)
+	s.samples[old] = sample
+
+	s.expire(time.Minute)
+	if _, ok := s.samples[old]; ok {
+		t.Error(`Stale counter was not expired`)
+	}
+	if _, ok := s.samples[fresh]; !ok {
+		t.Error(`Fresh counter was expired`)
+	}
+}
+
+func TestRateSetting(t *testing.T) {
+	tests := []struct {
+		options string
+		valid   bool
+		margin  int
+	}{
+		{options: ``, valid: true, margin: 10},
+		{options: `"rate.wrap.margin.percent":"1"`, valid: true,
+			margin: 1},
+		{options: `"rate.wrap.margin.percent":"100"`, valid: true,
+			margin: 100},
+		{options: `"rate.wrap.margin.percent":"-1"`, valid: false},
+		{options: `"rate.wrap.margin.percent":"101"`, valid: false},
+	}
+
+	for _, tc := range tests {
+		s := &Settings{}
+		err := s.fromJSON([]byte(`{"dustdevil":{` + tc.options + `}}`))
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: valid=%t, error: %v", tc.options, tc.valid,
+				err)
+			continue
+		}
+		if tc.valid && s.DustDevil.RateWrapMargin != tc.margin {
+			t.Errorf("%s: margin %d, expected %d", tc.options,
+				s.DustDevil.RateWrapMargin, tc.margin)
+		}
+	}
+}
+
+func TestRateBatch(t *testing.T) {
+	ts := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		keep     bool
+		ints     int
+		rateName string
+	}{
+		{keep: false, ints: 1, rateName: `/net/bytes/rate`},
+		{keep: true, ints: 3, rateName: `/net/bytes/rate`},
+	}
+
+	for _, tc := range tests {
+		options := `"rate.counter.paths":["/net/*"]`
+		if tc.keep {
+			options += `,"rate.keep.counters":"true"`
+		}
+		d := newTestHandler(t, `batch`, false, ``, options)
+
+		// samples out of order are sorted before deriving rates
+		batch := &legacy.MetricBatch{
+			HostID: 1,
+			Data: []legacy.MetricData{{
+				Time: ts.Add(10 * time.Second),
+				IntMetrics: []legacy.IntMetric{
+					{Metric: `/net/bytes`, Value: 1500},
+				},
+			}, {
+				Time: ts,
+				IntMetrics: []legacy.IntMetric{
+					{Metric: `/net/bytes`, Value: 1000},
+					{Metric: `/sys/processes`, Value: 100},
+				},
+			}},
+		}
+		d.rateBatch(batch, newProfileCache())
+
+		ints, rates := 0, []legacy.FloatMetric{}
+		for _, data := range batch.Data {
+			ints += len(data.IntMetrics)
+			rates = append(rates, data.FloatMetrics...)
+		}
+		if ints != tc.ints {
+			t.Errorf("keep=%t: %d counters left, expected %d",
+				tc.keep, ints, tc.ints)
+		}
+		if len(rates) != 1 || rates[0].Metric != tc.rateName ||
+			rates[0].Value != 50 {
+			t.Errorf("keep=%t: rates %+v", tc.keep, rates)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,118 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Relabel is a metric rewrite rule, modelled after Prometheus
+// relabel_configs. The regular expression is matched against the
+// source value and on a match, the target is set to the expanded
+// replacement. Rules are applied in order, each rule sees the result
+// of the previous ones.
+type Relabel struct {
+	// source value, either path, subtype or path_subtype for both
+	// joined by separator
+	Source string `json:"source"`
+	// separator for the path_subtype source, default ;
+	Separator string `json:"separator"`
+	// regular expression, anchored on both ends, default (.*)
+	Regex string `json:"regex"`
+	// field that is set, either path or subtype
+	Target string `json:"target"`
+	// replacement with $1 style group references, %{instance} is
+	// replaced by the instance name. Default $1
+	Replacement string `json:"replacement"`
+}
+
+// relabel is the compiled form of a Relabel
+type relabel struct {
+	source      string
+	separator   string
+	regex       *regexp.Regexp
+	target      string
+	replacement string
+	instance    bool
+}
+
+// compileRelabel returns the compiled form of r
+func compileRelabel(r Relabel) (*relabel, error) {
+	var err error
+
+	c := &relabel{
+		source:      r.Source,
+		separator:   r.Separator,
+		target:      r.Target,
+		replacement: r.Replacement,
+	}
+
+	switch c.source {
+	case `path`, `subtype`, `path_subtype`:
+	default:
+		return nil, fmt.Errorf("Relabel: unknown source %s", c.source)
+	}
+	switch c.target {
+	case `path`, `subtype`:
+	default:
+		return nil, fmt.Errorf("Relabel: unknown target %s", c.target)
+	}
+	if c.separator == `` {
+		c.separator = `;`
+	}
+	if r.Regex == `` {
+		r.Regex = `(.*)`
+	}
+	if c.regex, err = regexp.Compile(
+		`^(?:` + r.Regex + `)$`); err != nil {
+		return nil, fmt.Errorf("Relabel: %s", err)
+	}
+	if c.replacement == `` {
+		c.replacement = `$1`
+	}
+	c.instance = strings.Contains(c.replacement, `%{instance}`)
+	return c, nil
+}
+
+// apply returns path and subtype after applying the rule
+func (r *relabel) apply(path, subtype, instance string) (string, string) {
+	var value string
+	switch r.source {
+	case `path`:
+		value = path
+	case `subtype`:
+		value = subtype
+	case `path_subtype`:
+		value = path + r.separator + subtype
+	}
+
+	match := r.regex.FindStringSubmatchIndex(value)
+	if match == nil {
+		return path, subtype
+	}
+	replacement := r.replacement
+	if r.instance {
+		replacement = strings.Replace(replacement, `%{instance}`,
+			instance, -1)
+	}
+	result := string(r.regex.ExpandString(nil, replacement, value,
+		match))
+
+	switch r.target {
+	case `path`:
+		path = result
+	case `subtype`:
+		subtype = result
+	}
+	return path, subtype
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
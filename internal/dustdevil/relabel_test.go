@@ -0,0 +1,134 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"testing"
+
+	"github.com/solnx/legacy"
+)
+
+func TestCompileRelabel(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Relabel
+		valid bool
+	}{
+		{`defaults`, Relabel{Source: `path`, Target: `path`}, true},
+		{`path_subtype`, Relabel{Source: `path_subtype`,
+			Target: `subtype`, Separator: `|`}, true},
+		{`unknown source`, Relabel{Source: `host`, Target: `path`},
+			false},
+		{`unknown target`, Relabel{Source: `path`, Target: `tags`},
+			false},
+		{`broken regex`, Relabel{Source: `path`, Target: `path`,
+			Regex: `(`}, false},
+	}
+
+	for _, tc := range tests {
+		if _, err := compileRelabel(tc.rule); (err == nil) != tc.valid {
+			t.Errorf("%s: valid=%t, error: %v", tc.name, tc.valid, err)
+		}
+	}
+}
+
+func TestRelabelApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Relabel
+		path    string
+		subtype string
+		outPath string
+		outSub  string
+	}{
+		{`defaults copy the path`, Relabel{Source: `path`,
+			Target: `path`}, `/sys/load`, `a`, `/sys/load`, `a`},
+		{`path to subtype`, Relabel{Source: `path`, Target: `subtype`,
+			Regex: `/net/([^/]+)/.*`}, `/net/eth0/bytes`, ``,
+			`/net/eth0/bytes`, `eth0`},
+		{`regex is anchored`, Relabel{Source: `path`, Target: `path`,
+			Regex: `sys`, Replacement: `x`}, `/sys/load`, ``,
+			`/sys/load`, ``},
+		{`no match keeps values`, Relabel{Source: `subtype`,
+			Target: `path`, Regex: `eth.*`, Replacement: `/if`},
+			`/net/bytes`, `lo`, `/net/bytes`, `lo`},
+		{`path_subtype default separator`, Relabel{
+			Source: `path_subtype`, Target: `path`,
+			Regex: `(.*);(.*)`, Replacement: `$1/$2`}, `/net/bytes`,
+			`eth0`, `/net/bytes/eth0`, `eth0`},
+		{`path_subtype custom separator`, Relabel{
+			Source: `path_subtype`, Target: `subtype`, Separator: `|`,
+			Regex: `/disk/(.*)\|(.*)`, Replacement: `${2}_$1`},
+			`/disk/used`, `sda`, `/disk/used`, `sda_used`},
+		{`instance`, Relabel{Source: `path`, Target: `path`,
+			Replacement: `/%{instance}$1`}, `/sys/load`, ``,
+			`/dd1/sys/load`, ``},
+	}
+
+	for _, tc := range tests {
+		r, err := compileRelabel(tc.rule)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		path, subtype := r.apply(tc.path, tc.subtype, `dd1`)
+		if path != tc.outPath || subtype != tc.outSub {
+			t.Errorf("%s: %s, %s; expected %s, %s", tc.name, path,
+				subtype, tc.outPath, tc.outSub)
+		}
+	}
+}
+
+func TestRelabelBatch(t *testing.T) {
+	// rules see the result of the previous ones
+	d := newTestHandler(t, `batch`, false, ``, `"relabel":[
+		{"source":"path","target":"path","regex":"/old/(.*)",
+		 "replacement":"/new/$1"},
+		{"source":"path","target":"subtype","regex":"/new/(.*)"}
+	]`)
+
+	batch := &legacy.MetricBatch{
+		Data: []legacy.MetricData{{
+			FloatMetrics: []legacy.FloatMetric{
+				{Metric: `/old/load`},
+			},
+			IntMetrics: []legacy.IntMetric{
+				{Metric: `/sys/memory`, Subtype: `free`},
+			},
+			StringMetrics: []legacy.StringMetric{
+				{Metric: `/old/os`},
+			},
+		}},
+	}
+	d.relabelBatch(batch, newProfileCache())
+	data := batch.Data[0]
+
+	tests := []struct {
+		path    string
+		subtype string
+		outPath string
+		outSub  string
+	}{
+		{data.FloatMetrics[0].Metric, data.FloatMetrics[0].Subtype,
+			`/new/load`, `load`},
+		{data.IntMetrics[0].Metric, data.IntMetrics[0].Subtype,
+			`/sys/memory`, `free`},
+		{data.StringMetrics[0].Metric, data.StringMetrics[0].Subtype,
+			`/new/os`, `os`},
+	}
+
+	for _, tc := range tests {
+		if tc.path != tc.outPath || tc.subtype != tc.outSub {
+			t.Errorf("Relabeled to %s, %s; expected %s, %s", tc.path,
+				tc.subtype, tc.outPath, tc.outSub)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,108 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"text/template"
+)
+
+// Route is an entry of the routing table. All set match conditions
+// must be met for a metric to be forwarded to the route's endpoint.
+type Route struct {
+	// name of the route, used in metrics
+	Name string `json:"name"`
+	// comma separated list of host IDs and host ID ranges, ie.
+	// 5,10-20
+	HostIDs string `json:"host.ids"`
+	// regular expression matched against the metric path
+	MetricPath string `json:"metric.path"`
+	// topic the metric was consumed from
+	Topic string `json:"topic"`
+	// endpoint URL template, with HostID and Instance available
+	// as template data
+	Endpoint string `json:"endpoint"`
+}
+
+// route is the compiled form of a Route
+type route struct {
+	name     string
+	hosts    *hostSet
+	path     *regexp.Regexp
+	topic    string
+	endpoint *template.Template
+}
+
+// endpointData is the template data for endpoint URLs
+type endpointData struct {
+	HostID   int
+	Instance string
+}
+
+// compileRoute returns the compiled form of r
+func compileRoute(r Route) (*route, error) {
+	var err error
+
+	if r.Name == `` {
+		return nil, fmt.Errorf("Route without name")
+	}
+	if r.Endpoint == `` {
+		return nil, fmt.Errorf("Route %s has no endpoint", r.Name)
+	}
+
+	c := &route{
+		name:  r.Name,
+		topic: r.Topic,
+	}
+
+	if c.hosts, err = parseHostSet(r.HostIDs); err != nil {
+		return nil, fmt.Errorf("Route %s: %s", r.Name, err)
+	}
+
+	if r.MetricPath != `` {
+		if c.path, err = regexp.Compile(r.MetricPath); err != nil {
+			return nil, fmt.Errorf("Route %s: %s", r.Name, err)
+		}
+	}
+
+	if c.endpoint, err = template.New(r.Name).Parse(
+		r.Endpoint); err != nil {
+		return nil, fmt.Errorf("Route %s: %s", r.Name, err)
+	}
+	return c, nil
+}
+
+// matchHost returns true if the route applies to hostID and topic
+func (r *route) matchHost(hostID int, topic string) bool {
+	if r.topic != `` && r.topic != topic {
+		return false
+	}
+	return r.hosts.empty() || r.hosts.contains(hostID)
+}
+
+// matchPath returns true if the route applies to metric path
+func (r *route) matchPath(path string) bool {
+	return r.path == nil || r.path.MatchString(path)
+}
+
+// url returns the endpoint URL of the route for hostID
+func (r *route) url(hostID int, instance string) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := r.endpoint.Execute(buf, endpointData{
+		HostID:   hostID,
+		Instance: instance,
+	}); err != nil {
+		return ``, err
+	}
+	return buf.String(), nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,169 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/solnx/legacy"
+)
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes string
+		hostID int
+		topic  string
+		// expected endpoint and metric paths per route name
+		expected map[string]routeResult
+	}{
+		{name: `without routes`,
+			hostID: 7,
+			expected: map[string]routeResult{
+				`default`: {``, []string{`/sys/load`, `/sys/cpu`,
+					`/app/requests`}},
+			}},
+		{name: `first matching route wins`,
+			routes: `{"name":"sys","metric.path":"^/sys/",` +
+				`"endpoint":"http://sys"},` +
+				`{"name":"load","metric.path":"^/sys/load$",` +
+				`"endpoint":"http://load"}`,
+			hostID: 7,
+			expected: map[string]routeResult{
+				`sys`: {`http://sys`, []string{`/sys/load`,
+					`/sys/cpu`}},
+				`default`: {``, []string{`/app/requests`}},
+			}},
+		{name: `more specific route listed first`,
+			routes: `{"name":"load","metric.path":"^/sys/load$",` +
+				`"endpoint":"http://load"},` +
+				`{"name":"sys","metric.path":"^/sys/",` +
+				`"endpoint":"http://sys"}`,
+			hostID: 7,
+			expected: map[string]routeResult{
+				`load`:    {`http://load`, []string{`/sys/load`}},
+				`sys`:     {`http://sys`, []string{`/sys/cpu`}},
+				`default`: {``, []string{`/app/requests`}},
+			}},
+		{name: `route without path takes all metrics`,
+			routes: `{"name":"all","endpoint":"http://all"}`,
+			hostID: 7,
+			expected: map[string]routeResult{
+				`all`: {`http://all`, []string{`/sys/load`, `/sys/cpu`,
+					`/app/requests`}},
+			}},
+		{name: `other host falls back to the pool`,
+			routes: `{"name":"sys","host.ids":"1-5",` +
+				`"endpoint":"http://sys"}`,
+			hostID: 7,
+			expected: map[string]routeResult{
+				`default`: {``, []string{`/sys/load`, `/sys/cpu`,
+					`/app/requests`}},
+			}},
+		{name: `other topic falls back to the pool`,
+			routes: `{"name":"sys","topic":"metrics",` +
+				`"endpoint":"http://sys"}`,
+			hostID: 7, topic: `other`,
+			expected: map[string]routeResult{
+				`default`: {``, []string{`/sys/load`, `/sys/cpu`,
+					`/app/requests`}},
+			}},
+		{name: `templated endpoint`,
+			routes: `{"name":"app","host.ids":"7","topic":"metrics",` +
+				`"metric.path":"^/app/","endpoint":` +
+				`"http://{{.Instance}}/host/{{.HostID}}"}`,
+			hostID: 7, topic: `metrics`,
+			expected: map[string]routeResult{
+				`app`: {`http://dd1/host/7`,
+					[]string{`/app/requests`}},
+				`default`: {``, []string{`/sys/load`, `/sys/cpu`}},
+			}},
+	}
+
+	ts := time.Now().UTC().Truncate(time.Second)
+	for _, tc := range tests {
+		d := newTestHandler(t, `batch`, false, ``,
+			`"routes":[`+tc.routes+`]`)
+		d.Config.Misc.InstanceName = `dd1`
+
+		routed, err := d.route(legacy.MetricBatch{
+			HostID: tc.hostID,
+			Data: []legacy.MetricData{{
+				Time: ts,
+				FloatMetrics: []legacy.FloatMetric{
+					{Metric: `/sys/load`},
+					{Metric: `/sys/cpu`},
+				},
+				IntMetrics: []legacy.IntMetric{
+					{Metric: `/app/requests`},
+				},
+			}},
+		}, tc.topic)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		results := map[string]routeResult{}
+		for _, rb := range routed {
+			paths := []string{}
+			for _, data := range rb.batch.Data {
+				if !data.Time.Equal(ts) {
+					t.Errorf("%s: route %s has time %s", tc.name,
+						rb.route, data.Time)
+				}
+				for _, m := range data.FloatMetrics {
+					paths = append(paths, m.Metric)
+				}
+				for _, m := range data.IntMetrics {
+					paths = append(paths, m.Metric)
+				}
+			}
+			results[rb.route] = routeResult{rb.endpoint, paths}
+		}
+		if !reflect.DeepEqual(results, tc.expected) {
+			t.Errorf("%s: routed %v, expected %v", tc.name, results,
+				tc.expected)
+		}
+	}
+}
+
+// routeResult is the endpoint and metric paths of a routedBatch
+type routeResult struct {
+	endpoint string
+	paths    []string
+}
+
+func TestRouteSetting(t *testing.T) {
+	tests := []struct {
+		route string
+		valid bool
+	}{
+		{`{"name":"a","endpoint":"http://a"}`, true},
+		{`{"endpoint":"http://a"}`, false},
+		{`{"name":"a"}`, false},
+		{`{"name":"a","endpoint":"http://a","host.ids":"x"}`, false},
+		{`{"name":"a","endpoint":"http://a","metric.path":"("}`,
+			false},
+		{`{"name":"a","endpoint":"http://{{.HostID"}`, false},
+	}
+
+	for _, tc := range tests {
+		s := &Settings{}
+		err := s.fromJSON([]byte(`{"dustdevil":{"routes":[` +
+			tc.route + `]}}`))
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: valid=%t, error: %v", tc.route, tc.valid,
+				err)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
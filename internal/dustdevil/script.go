@@ -0,0 +1,285 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/solnx/legacy"
+	"go.starlark.net/starlark"
+)
+
+// script is a loaded Starlark transformation script. Its globals are
+// frozen after loading, which allows concurrent calls.
+type script struct {
+	fn      starlark.Callable
+	timeout time.Duration
+}
+
+// loadScript executes the Starlark file fname and returns the script
+// calling its global function name
+func loadScript(fname, name string, timeout time.Duration) (*script, error) {
+	src, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	thread := &starlark.Thread{Name: `load`}
+	globals, err := starlark.ExecFile(thread, fname, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	globals.Freeze()
+
+	fn, ok := globals[name].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("Script %s does not define function %s",
+			fname, name)
+	}
+	return &script{fn: fn, timeout: timeout}, nil
+}
+
+// call passes batch to the script function and returns the batch it
+// returned. If the script returned None, ok is false and the batch
+// is to be dropped.
+func (s *script) call(batch legacy.MetricBatch) (res legacy.MetricBatch, ok bool, err error) {
+	thread := &starlark.Thread{Name: `transform`}
+	timer := time.AfterFunc(s.timeout, func() {
+		thread.Cancel(`timeout`)
+	})
+	defer timer.Stop()
+
+	v, err := starlark.Call(thread, s.fn, starlark.Tuple{
+		batchToStarlark(batch),
+	}, nil)
+	if err != nil {
+		return res, false, err
+	}
+	if v == starlark.None {
+		return res, false, nil
+	}
+	if res, err = batchFromStarlark(v); err != nil {
+		return res, false, err
+	}
+	return res, true, nil
+}
+
+// batchToStarlark returns batch as Starlark dict:
+//
+//	{'hostID': 1, 'data': [{'time': '<RFC3339>',
+//	  'float': [{'metric': m, 'subtype': s, 'value': 1.0}],
+//	  'int': [...], 'string': [...]}]}
+func batchToStarlark(batch legacy.MetricBatch) starlark.Value {
+	data := make([]starlark.Value, 0, len(batch.Data))
+	for _, md := range batch.Data {
+		floats := make([]starlark.Value, 0, len(md.FloatMetrics))
+		for _, m := range md.FloatMetrics {
+			floats = append(floats, metricDict(m.Metric, m.Subtype,
+				starlark.Float(m.Value)))
+		}
+		ints := make([]starlark.Value, 0, len(md.IntMetrics))
+		for _, m := range md.IntMetrics {
+			ints = append(ints, metricDict(m.Metric, m.Subtype,
+				starlark.MakeInt64(m.Value)))
+		}
+		strs := make([]starlark.Value, 0, len(md.StringMetrics))
+		for _, m := range md.StringMetrics {
+			strs = append(strs, metricDict(m.Metric, m.Subtype,
+				starlark.String(m.Value)))
+		}
+
+		d := starlark.NewDict(4)
+		d.SetKey(starlark.String(`time`),
+			starlark.String(md.Time.Format(time.RFC3339Nano)))
+		d.SetKey(starlark.String(`float`), starlark.NewList(floats))
+		d.SetKey(starlark.String(`int`), starlark.NewList(ints))
+		d.SetKey(starlark.String(`string`), starlark.NewList(strs))
+		data = append(data, d)
+	}
+
+	b := starlark.NewDict(2)
+	b.SetKey(starlark.String(`hostID`), starlark.MakeInt(batch.HostID))
+	b.SetKey(starlark.String(`data`), starlark.NewList(data))
+	return b
+}
+
+// metricDict returns a metric as Starlark dict
+func metricDict(metric, subtype string, value starlark.Value) *starlark.Dict {
+	d := starlark.NewDict(3)
+	d.SetKey(starlark.String(`metric`), starlark.String(metric))
+	d.SetKey(starlark.String(`subtype`), starlark.String(subtype))
+	d.SetKey(starlark.String(`value`), value)
+	return d
+}
+
+// batchFromStarlark is the inverse of batchToStarlark
+func batchFromStarlark(v starlark.Value) (legacy.MetricBatch, error) {
+	batch := legacy.MetricBatch{Protocol: 1}
+
+	b, ok := v.(*starlark.Dict)
+	if !ok {
+		return batch, fmt.Errorf("Script returned %s, not dict", v.Type())
+	}
+	hostID, err := dictGet(b, `hostID`)
+	if err != nil {
+		return batch, err
+	}
+	if err = starlark.AsInt(hostID, &batch.HostID); err != nil {
+		return batch, fmt.Errorf("Script returned invalid hostID: %s",
+			err)
+	}
+
+	data, err := dictList(b, `data`)
+	if err != nil {
+		return batch, err
+	}
+	batch.Data = make([]legacy.MetricData, 0, len(data))
+	for _, dv := range data {
+		md, err := dataFromStarlark(dv)
+		if err != nil {
+			return batch, err
+		}
+		batch.Data = append(batch.Data, md)
+	}
+	return batch, nil
+}
+
+// dataFromStarlark converts a data dict to MetricData
+func dataFromStarlark(v starlark.Value) (legacy.MetricData, error) {
+	md := legacy.MetricData{
+		FloatMetrics:  make([]legacy.FloatMetric, 0),
+		StringMetrics: make([]legacy.StringMetric, 0),
+		IntMetrics:    make([]legacy.IntMetric, 0),
+	}
+
+	d, ok := v.(*starlark.Dict)
+	if !ok {
+		return md, fmt.Errorf("Script returned data %s, not dict",
+			v.Type())
+	}
+	tv, err := dictGet(d, `time`)
+	if err != nil {
+		return md, err
+	}
+	ts, ok := starlark.AsString(tv)
+	if !ok {
+		return md, fmt.Errorf("Script returned time %s, not string",
+			tv.Type())
+	}
+	if md.Time, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+		return md, err
+	}
+
+	for _, kind := range []string{`float`, `int`, `string`} {
+		list, err := dictList(d, kind)
+		if err != nil {
+			return md, err
+		}
+		for _, mv := range list {
+			m, ok := mv.(*starlark.Dict)
+			if !ok {
+				return md, fmt.Errorf("Script returned %s metric"+
+					" %s, not dict", kind, mv.Type())
+			}
+			metric, subtype, value, err := metricFromStarlark(m)
+			if err != nil {
+				return md, err
+			}
+			switch kind {
+			case `float`:
+				f, ok := starlark.AsFloat(value)
+				if !ok {
+					return md, fmt.Errorf("Script returned float"+
+						" metric %s with %s value", metric,
+						value.Type())
+				}
+				md.FloatMetrics = append(md.FloatMetrics,
+					legacy.FloatMetric{Metric: metric,
+						Subtype: subtype, Value: f})
+			case `int`:
+				var i int64
+				iv, ok := value.(starlark.Int)
+				if ok {
+					i, ok = iv.Int64()
+				}
+				if !ok {
+					return md, fmt.Errorf("Script returned int"+
+						" metric %s with %s value", metric,
+						value.Type())
+				}
+				md.IntMetrics = append(md.IntMetrics,
+					legacy.IntMetric{Metric: metric,
+						Subtype: subtype, Value: i})
+			case `string`:
+				s, ok := starlark.AsString(value)
+				if !ok {
+					return md, fmt.Errorf("Script returned string"+
+						" metric %s with %s value", metric,
+						value.Type())
+				}
+				md.StringMetrics = append(md.StringMetrics,
+					legacy.StringMetric{Metric: metric,
+						Subtype: subtype, Value: s})
+			}
+		}
+	}
+	return md, nil
+}
+
+// metricFromStarlark returns the fields of a metric dict
+func metricFromStarlark(m *starlark.Dict) (metric, subtype string, value starlark.Value, err error) {
+	var v starlark.Value
+	if v, err = dictGet(m, `metric`); err != nil {
+		return
+	}
+	metric, _ = starlark.AsString(v)
+	if v, _, err = m.Get(starlark.String(`subtype`)); err != nil {
+		return
+	}
+	if v != nil {
+		subtype, _ = starlark.AsString(v)
+	}
+	value, err = dictGet(m, `value`)
+	return
+}
+
+// dictGet returns the value of key in d
+func dictGet(d *starlark.Dict, key string) (starlark.Value, error) {
+	v, found, err := d.Get(starlark.String(key))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("Script returned dict without %s", key)
+	}
+	return v, nil
+}
+
+// dictList returns the elements of the list value of key in d. A
+// missing key is an empty list.
+func dictList(d *starlark.Dict, key string) ([]starlark.Value, error) {
+	v, found, err := d.Get(starlark.String(key))
+	if err != nil || !found {
+		return nil, err
+	}
+	l, ok := v.(*starlark.List)
+	if !ok {
+		return nil, fmt.Errorf("Script returned %s %s, not list", key,
+			v.Type())
+	}
+	values := make([]starlark.Value, 0, l.Len())
+	for i := 0; i < l.Len(); i++ {
+		values = append(values, l.Index(i))
+	}
+	return values, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
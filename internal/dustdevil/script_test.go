@@ -0,0 +1,192 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// writeScript writes the Starlark source src to a temporary file and
+// returns its name
+func writeScript(t *testing.T, src string) string {
+	t.Helper()
+	fname := filepath.Join(t.TempDir(), `transform.star`)
+	if err := ioutil.WriteFile(fname, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+// testScriptBatch returns a batch with one metric of every type
+func testScriptBatch() legacy.MetricBatch {
+	return legacy.MetricBatch{
+		HostID:   12,
+		Protocol: 1,
+		Data: []legacy.MetricData{{
+			Time: time.Date(2017, 6, 1, 12, 0, 0, 5, time.UTC),
+			FloatMetrics: []legacy.FloatMetric{
+				{Metric: `/sys/load`, Subtype: `1m`, Value: 0.5},
+			},
+			IntMetrics: []legacy.IntMetric{
+				{Metric: `/sys/processes`, Value: -3},
+			},
+			StringMetrics: []legacy.StringMetric{
+				{Metric: `/sys/os`, Value: `linux`},
+			},
+		}},
+	}
+}
+
+func TestScriptRoundTrip(t *testing.T) {
+	batch := testScriptBatch()
+	res, err := batchFromStarlark(batchToStarlark(batch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, batch) {
+		t.Errorf("Round trip returned %+v, expected %+v", res, batch)
+	}
+
+	s, err := loadScript(writeScript(t, "def transform(b):\n"+
+		"    return b\n"), `transform`, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, ok, err := s.call(batch)
+	if err != nil || !ok || !reflect.DeepEqual(res, batch) {
+		t.Errorf("Identity script returned %+v, %t, %v", res, ok, err)
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		// substring of the error, empty if the batch is dropped
+		err string
+	}{
+		{`drop`, `return None`, ``},
+		{`not a dict`, `return 1`, `not dict`},
+		{`without hostID`, `return {'data': []}`, `without hostID`},
+		{`invalid hostID`, `return {'hostID': 'a', 'data': []}`,
+			`invalid hostID`},
+		{`data not a list`, `return {'hostID': 1, 'data': 1}`,
+			`not list`},
+		{`broken time`, `return {'hostID': 1, 'data': ` +
+			`[{'time': 'noon'}]}`, `cannot parse`},
+		{`float with string value`, `return {'hostID': 1, 'data': ` +
+			`[{'time': b['data'][0]['time'], 'float': ` +
+			`[{'metric': '/a', 'value': 'x'}]}]}`, `string value`},
+		{`int with float value`, `return {'hostID': 1, 'data': ` +
+			`[{'time': b['data'][0]['time'], 'int': ` +
+			`[{'metric': '/a', 'value': 1.5}]}]}`, `float value`},
+		{`metric without value`, `return {'hostID': 1, 'data': ` +
+			`[{'time': b['data'][0]['time'], 'string': ` +
+			`[{'metric': '/a'}]}]}`, `without value`},
+		{`runtime error`, `return b['missing']`, `missing`},
+		{`timeout`, `return [x for x in range(100000000)]`,
+			`timeout`},
+	}
+
+	for _, tc := range tests {
+		s, err := loadScript(writeScript(t, "def transform(b):\n    "+
+			tc.body+"\n"), `transform`, 50*time.Millisecond)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		_, ok, err := s.call(testScriptBatch())
+		switch {
+		case tc.err == `` && (ok || err != nil):
+			t.Errorf("%s: ok=%t, error %v, expected drop", tc.name,
+				ok, err)
+		case tc.err != `` && (err == nil ||
+			!strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: error %v, expected %q", tc.name, err,
+				tc.err)
+		}
+	}
+}
+
+func TestLoadScript(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		fn   string
+		ok   bool
+	}{
+		{`valid`, "def transform(b):\n    return b\n", `transform`,
+			true},
+		{`syntax error`, "def transform(b)\n", `transform`, false},
+		{`missing function`, "x = 1\n", `transform`, false},
+		{`not callable`, "transform = 1\n", `transform`, false},
+	}
+
+	for _, tc := range tests {
+		_, err := loadScript(writeScript(t, tc.src), tc.fn, time.Second)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: ok=%t, error %v", tc.name, tc.ok, err)
+		}
+	}
+}
+
+// TestScriptBatch checks that dropped metrics and failed calls are
+// counted
+func TestScriptBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		metrics int
+		dropped int64
+		errors  int64
+	}{
+		{`unmodified`, `return b`, 3, 0, 0},
+		{`drop batch`, `return None`, 0, 3, 0},
+		{`drop strings`, `b['data'][0]['string'] = []` + "\n    " +
+			`return b`, 2, 1, 0},
+		{`error keeps batch`, `return 1`, 3, 0, 1},
+	}
+
+	for _, tc := range tests {
+		d := newTestHandler(t, `batch`, false, ``,
+			`"script.file":"`+writeScript(t, "def transform(b):\n    "+
+				tc.body+"\n")+`"`)
+		batch := testScriptBatch()
+		d.scriptBatch(&batch, nil)
+
+		if n, _ := countMetrics(batch); n != tc.metrics {
+			t.Errorf("%s: %d metrics left, expected %d", tc.name, n,
+				tc.metrics)
+		}
+		st, _ := d.Stats.Lookup(12)
+		if st.Dropped != tc.dropped {
+			t.Errorf("%s: host dropped %d metrics, expected %d",
+				tc.name, st.Dropped, tc.dropped)
+		}
+		if n := metrics.GetOrRegisterCounter(`/script/metrics.dropped`,
+			*d.Metrics).Count(); n != tc.dropped {
+			t.Errorf("%s: counted %d dropped metrics, expected %d",
+				tc.name, n, tc.dropped)
+		}
+		if n := metrics.GetOrRegisterCounter(`/script/errors`,
+			*d.Metrics).Count(); n != tc.errors {
+			t.Errorf("%s: counted %d errors, expected %d", tc.name, n,
+				tc.errors)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
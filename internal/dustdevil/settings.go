@@ -0,0 +1,483 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	ucl "github.com/nahanni/go-ucl"
+)
+
+// settings is the package wide configuration used outside of the
+// handlers, ie. by Dispatch
+var settings *Settings
+
+// Settings holds the DustDevil configuration options that are not
+// part of erebos.Config. They are read from the same configuration
+// file.
+type Settings struct {
+	DustDevil struct {
+		// compression codec of consumed messages, one of auto,
+		// none, gzip, zstd, snappy or lz4
+		InputCompression string `json:"input.compression"`
+		// wire format of consumed messages, one of auto, json or
+		// msgpack
+		InputEncoding string `json:"input.encoding"`
+		// per topic override of InputEncoding
+		TopicEncoding map[string]string `json:"input.encoding.topics"`
+		// compression of POST request bodies, one of none, gzip or
+		// zstd
+		OutputCompression string `json:"output.compression"`
+		// codec specific compression level
+		OutputCompressionLevel int `json:"output.compression.level,string"`
+		// request bodies smaller than this are sent uncompressed
+		OutputCompressionMinSize int `json:"output.compression.min.bytes,string"`
+		// pack the MetricBatch of several hosts into one request
+		Aggregate bool `json:"aggregate.requests,string"`
+		// format of aggregated requests, either array or ndjson
+		AggregateFormat string `json:"aggregate.format"`
+		// maximum body size of aggregated requests
+		AggregateMaxBytes int `json:"aggregate.max.bytes,string"`
+		// maximum number of MetricBatch per aggregated request
+		AggregateMaxHosts int `json:"aggregate.max.hosts,string"`
+		// maximum time in ms a MetricBatch waits for aggregation
+		AggregateMaxDelay int `json:"aggregate.max.delay.ms,string"`
+		// routing table, evaluated in order
+		Routes []Route `json:"routes"`
+		// list of equivalent endpoints, replaces api.endpoint
+		Endpoints []string `json:"api.endpoints"`
+		// balancing across Endpoints, one of round-robin,
+		// least-inflight or hash
+		Balance string `json:"api.endpoints.balance"`
+		// consecutive failures after which an endpoint is ejected
+		EjectThreshold int `json:"api.endpoints.eject.threshold,string"`
+		// time in ms an ejected endpoint is not used
+		EjectCooldown int `json:"api.endpoints.eject.cooldown.ms,string"`
+		// metric filter rules, evaluated in order
+		Filters []Filter `json:"filters"`
+		// metric relabel rules, applied in order
+		Relabels []Relabel `json:"relabel"`
+		// attach eyewall profiles to Elasticsearch documents
+		Enrich bool `json:"enrich.profiles,string"`
+		// drop metrics without eyewall profile
+		EnrichDropUnconfigured bool `json:"enrich.drop.unconfigured,string"`
+		// path globs of integer counters that are converted to
+		// per second rates
+		RateCounterPaths []string `json:"rate.counter.paths"`
+		// suffix appended to the path of rate metrics
+		RateSuffix string `json:"rate.suffix"`
+		// forward the counters in addition to their rates
+		RateKeepCounters bool `json:"rate.keep.counters,string"`
+		// counter width in bits for wrap detection, 0 treats every
+		// decrease as reset
+		RateCounterBits int `json:"rate.counter.bits,string"`
+		// a decrease is only a wrap if the wrapped increase is at
+		// most this percentage of the counter range, otherwise it
+		// is a reset
+		RateWrapMargin int `json:"rate.wrap.margin.percent,string"`
+		// seconds after which the state of a quiet counter expires
+		RateExpiry int `json:"rate.state.expiry.seconds,string"`
+		// size of the downsampling windows in seconds, 0 disables
+		// downsampling
+		DownsampleWindow int `json:"downsample.window.seconds,string"`
+		// seconds after the end of a window that late samples are
+		// still accepted
+		DownsampleGrace int `json:"downsample.grace.seconds,string"`
+		// aggregates emitted per window, any of min, max, avg, sum,
+		// count and last
+		DownsampleFunctions []string `json:"downsample.functions"`
+		// seconds a timestamp may be ahead of the reference time,
+		// 0 disables the check
+		TimestampMaxFuture int `json:"timestamp.max.future.seconds,string"`
+		// seconds a timestamp may be behind the reference time,
+		// 0 disables the check
+		TimestampMaxPast int `json:"timestamp.max.past.seconds,string"`
+		// reference time of the timestamp checks, only wall is
+		// supported
+		TimestampReference string `json:"timestamp.reference"`
+		// handling of out of range timestamps, one of drop, clamp
+		// or deadletter
+		TimestampPolicy string `json:"timestamp.policy"`
+		// file that rejected metrics are written to
+		DeadLetterFile string `json:"deadletter.file"`
+		// rules converting string metrics into integer metrics,
+		// the first matching rule is applied
+		StringConversions []StringConversion `json:"string.conversions"`
+		// forwarded metrics per second per host, 0 disables the
+		// limit
+		LimitHostRate int `json:"limit.host.metrics.per.second,string"`
+		// token bucket size of the per host limit
+		LimitHostBurst int `json:"limit.host.burst,string"`
+		// forwarded metrics per second in total, 0 disables the
+		// limit
+		LimitGlobalRate int `json:"limit.global.metrics.per.second,string"`
+		// token bucket size of the global limit
+		LimitGlobalBurst int `json:"limit.global.burst,string"`
+		// handling of metrics exceeding a limit, either drop or
+		// deadletter
+		LimitPolicy string `json:"limit.policy"`
+		// sampling rules, the first matching rule is applied
+		Samples []Sample `json:"sampling"`
+		// Starlark file with the transformation script, empty
+		// disables the scripting hook
+		ScriptFile string `json:"script.file"`
+		// name of the script function called for each batch
+		ScriptFunction string `json:"script.function"`
+		// maximum execution time in ms of a script call
+		ScriptTimeout int `json:"script.timeout.ms,string"`
+		// address of the HTTP listener serving /metrics in
+		// Prometheus format, empty disables the listener
+		HTTPListen string `json:"http.listen"`
+		// seconds without heartbeat after which a handler is not
+		// ready
+		HealthReadyAfter int `json:"health.ready.after.seconds,string"`
+		// seconds without progress after which the main loop or a
+		// handler is not alive
+		HealthLiveAfter int `json:"health.live.after.seconds,string"`
+		// seconds a failing endpoint is tolerated before not being
+		// ready
+		HealthPostWindow int `json:"health.post.window.seconds,string"`
+		// bearer token of the admin API served by the HTTP
+		// listener, empty disables the admin API
+		AdminToken string `json:"admin.token"`
+		// format of the logfile, either text or json
+		LogFormat string `json:"log.format"`
+		// host:port of the OTLP/HTTP trace collector, empty keeps
+		// tracing disabled
+		TracingEndpoint string `json:"tracing.otlp.endpoint"`
+		// send traces without TLS
+		TracingInsecure bool `json:"tracing.otlp.insecure,string"`
+		// fraction of messages that are traced
+		TracingSampleRatio string `json:"tracing.sample.ratio"`
+		// seconds without progress after which a handler is
+		// reported as stalled, 0 disables the watchdog
+		WatchdogStall int `json:"watchdog.stall.seconds,string"`
+		// shut down after a stalled handler, to be restarted by
+		// the service supervisor
+		WatchdogRestart bool `json:"watchdog.restart,string"`
+		// seconds the shutdown after a stalled handler may take
+		// before dustdevil exits without waiting for the handlers
+		WatchdogShutdown int `json:"watchdog.shutdown.seconds,string"`
+		// number of hosts with delivery statistics, the host seen
+		// least recently is evicted
+		HostStatsMaxHosts int `json:"hoststats.max.hosts,string"`
+		// number of hosts by volume whose statistics are reported
+		// as metrics, 0 disables the report
+		HostStatsTop int `json:"hoststats.top,string"`
+	} `json:"dustdevil"`
+
+	// unexported
+	routes      []*route
+	filters     []*filter
+	relabels    []*relabel
+	conversions []*conversion
+	samples     []*sample
+	script      *script
+}
+
+// validEncoding returns an error if enc, configured as option, is
+// not a supported input encoding
+func validEncoding(option, enc string) error {
+	switch enc {
+	case `auto`, `json`, `msgpack`:
+		return nil
+	}
+	return fmt.Errorf("Unknown %s: %s", option, enc)
+}
+
+// FromFile reads the settings from the configuration file fname
+func (s *Settings) FromFile(fname string) error {
+	var (
+		file, uclJSON []byte
+		uclData       map[string]interface{}
+		err           error
+	)
+
+	if file, err = ioutil.ReadFile(fname); err != nil {
+		return err
+	}
+
+	// UCL parses into map[string]interface{}
+	parser := ucl.NewParser(bytes.NewBuffer(file))
+	if uclData, err = parser.Ucl(); err != nil {
+		return err
+	}
+
+	// take detour via JSON to load UCL into struct
+	if uclJSON, err = json.Marshal(uclData); err != nil {
+		return err
+	}
+	return s.fromJSON(uclJSON)
+}
+
+// fromJSON reads the settings from their JSON form data, sets the
+// defaults of unset options and compiles the rules
+func (s *Settings) fromJSON(data []byte) error {
+	var err error
+	if err = json.Unmarshal(data, s); err != nil {
+		return err
+	}
+
+	// set defaults for unset options
+	if s.DustDevil.InputCompression == `` {
+		s.DustDevil.InputCompression = `auto`
+	}
+	switch s.DustDevil.InputCompression {
+	case `auto`, `none`, `gzip`, `zstd`, `snappy`, `lz4`:
+	default:
+		return fmt.Errorf("Unknown input.compression: %s",
+			s.DustDevil.InputCompression)
+	}
+	if s.DustDevil.InputEncoding == `` {
+		s.DustDevil.InputEncoding = `auto`
+	}
+	if err = validEncoding(`input.encoding`,
+		s.DustDevil.InputEncoding); err != nil {
+		return err
+	}
+	for topic, enc := range s.DustDevil.TopicEncoding {
+		if err = validEncoding(`input.encoding.topics `+topic,
+			enc); err != nil {
+			return err
+		}
+	}
+	if s.DustDevil.OutputCompression == `` {
+		s.DustDevil.OutputCompression = `none`
+	}
+	switch s.DustDevil.OutputCompression {
+	case `none`:
+	case `gzip`:
+		// gzip.HuffmanOnly to gzip.BestCompression
+		if s.DustDevil.OutputCompressionLevel < -2 ||
+			s.DustDevil.OutputCompressionLevel > 9 {
+			return fmt.Errorf("output.compression.level %d is"+
+				" outside of -2..9 for gzip",
+				s.DustDevil.OutputCompressionLevel)
+		}
+	case `zstd`:
+		// 0 selects the default level
+		if s.DustDevil.OutputCompressionLevel < 0 ||
+			s.DustDevil.OutputCompressionLevel > 22 {
+			return fmt.Errorf("output.compression.level %d is"+
+				" outside of 0..22 for zstd",
+				s.DustDevil.OutputCompressionLevel)
+		}
+	default:
+		return fmt.Errorf("Unknown output.compression: %s",
+			s.DustDevil.OutputCompression)
+	}
+	if s.DustDevil.AggregateFormat == `` {
+		s.DustDevil.AggregateFormat = `array`
+	}
+	switch s.DustDevil.AggregateFormat {
+	case `array`, `ndjson`:
+	default:
+		return fmt.Errorf("Unknown aggregate.format: %s",
+			s.DustDevil.AggregateFormat)
+	}
+	if s.DustDevil.AggregateMaxBytes == 0 {
+		s.DustDevil.AggregateMaxBytes = 1048576
+	}
+	if s.DustDevil.AggregateMaxHosts == 0 {
+		s.DustDevil.AggregateMaxHosts = 100
+	}
+	if s.DustDevil.AggregateMaxDelay == 0 {
+		s.DustDevil.AggregateMaxDelay = 1000
+	}
+	if s.DustDevil.RateSuffix == `` {
+		s.DustDevil.RateSuffix = `/rate`
+	}
+	if s.DustDevil.RateWrapMargin == 0 {
+		s.DustDevil.RateWrapMargin = 10
+	}
+	if s.DustDevil.RateWrapMargin < 0 ||
+		s.DustDevil.RateWrapMargin > 100 {
+		return fmt.Errorf("rate.wrap.margin.percent %d is outside"+
+			" of 1..100", s.DustDevil.RateWrapMargin)
+	}
+	if s.DustDevil.RateExpiry == 0 {
+		s.DustDevil.RateExpiry = 3600
+	}
+	if s.DustDevil.DownsampleGrace == 0 {
+		s.DustDevil.DownsampleGrace = 60
+	}
+	if len(s.DustDevil.DownsampleFunctions) == 0 {
+		s.DustDevil.DownsampleFunctions = []string{
+			`min`, `max`, `avg`, `sum`, `count`, `last`,
+		}
+	}
+	for _, fn := range s.DustDevil.DownsampleFunctions {
+		switch fn {
+		case `min`, `max`, `avg`, `sum`, `count`, `last`:
+		default:
+			return fmt.Errorf("Unknown downsample function: %s", fn)
+		}
+	}
+	if s.DustDevil.TimestampReference == `` {
+		s.DustDevil.TimestampReference = `wall`
+	}
+	if s.DustDevil.TimestampReference != `wall` {
+		// erebos.Transport does not carry the Kafka message
+		// timestamp
+		return fmt.Errorf("Unsupported timestamp.reference: %s",
+			s.DustDevil.TimestampReference)
+	}
+	if s.DustDevil.TimestampPolicy == `` {
+		s.DustDevil.TimestampPolicy = `drop`
+	}
+	switch s.DustDevil.TimestampPolicy {
+	case `drop`, `clamp`:
+	case `deadletter`:
+		if s.DustDevil.DeadLetterFile == `` {
+			return fmt.Errorf("timestamp.policy deadletter" +
+				" requires deadletter.file")
+		}
+	default:
+		return fmt.Errorf("Unknown timestamp.policy: %s",
+			s.DustDevil.TimestampPolicy)
+	}
+	if s.DustDevil.LimitPolicy == `` {
+		s.DustDevil.LimitPolicy = `drop`
+	}
+	switch s.DustDevil.LimitPolicy {
+	case `drop`:
+	case `deadletter`:
+		if s.DustDevil.DeadLetterFile == `` {
+			return fmt.Errorf("limit.policy deadletter" +
+				" requires deadletter.file")
+		}
+	default:
+		return fmt.Errorf("Unknown limit.policy: %s",
+			s.DustDevil.LimitPolicy)
+	}
+	if s.DustDevil.ScriptFunction == `` {
+		s.DustDevil.ScriptFunction = `transform`
+	}
+	if s.DustDevil.ScriptTimeout == 0 {
+		s.DustDevil.ScriptTimeout = 100
+	}
+	if s.DustDevil.HealthReadyAfter == 0 {
+		s.DustDevil.HealthReadyAfter = 30
+	}
+	if s.DustDevil.HealthLiveAfter == 0 {
+		s.DustDevil.HealthLiveAfter = 120
+	}
+	if s.DustDevil.HealthPostWindow == 0 {
+		s.DustDevil.HealthPostWindow = 60
+	}
+	switch s.DustDevil.LogFormat {
+	case ``:
+		s.DustDevil.LogFormat = `text`
+	case `text`, `json`:
+	default:
+		return fmt.Errorf("Unknown log.format: %s",
+			s.DustDevil.LogFormat)
+	}
+	if s.DustDevil.WatchdogShutdown == 0 {
+		s.DustDevil.WatchdogShutdown = 30
+	}
+	if s.DustDevil.HostStatsMaxHosts == 0 {
+		s.DustDevil.HostStatsMaxHosts = 10000
+	}
+	if s.DustDevil.HostStatsTop > s.DustDevil.HostStatsMaxHosts {
+		return fmt.Errorf("hoststats.top %d exceeds"+
+			" hoststats.max.hosts %d", s.DustDevil.HostStatsTop,
+			s.DustDevil.HostStatsMaxHosts)
+	}
+	if s.DustDevil.TracingSampleRatio == `` {
+		s.DustDevil.TracingSampleRatio = `1`
+	}
+	if s.DustDevil.Balance == `` {
+		s.DustDevil.Balance = `round-robin`
+	}
+	switch s.DustDevil.Balance {
+	case `round-robin`, `least-inflight`, `hash`:
+	default:
+		return fmt.Errorf("Unknown api.endpoints.balance: %s",
+			s.DustDevil.Balance)
+	}
+	if s.DustDevil.EjectThreshold == 0 {
+		s.DustDevil.EjectThreshold = 3
+	}
+	if s.DustDevil.EjectCooldown == 0 {
+		s.DustDevil.EjectCooldown = 30000
+	}
+
+	// compile the routing table
+	s.routes = make([]*route, 0, len(s.DustDevil.Routes))
+	for _, r := range s.DustDevil.Routes {
+		var c *route
+		if c, err = compileRoute(r); err != nil {
+			return err
+		}
+		s.routes = append(s.routes, c)
+	}
+
+	// compile the filter rules
+	s.filters = make([]*filter, 0, len(s.DustDevil.Filters))
+	for _, f := range s.DustDevil.Filters {
+		var c *filter
+		if c, err = compileFilter(f); err != nil {
+			return err
+		}
+		s.filters = append(s.filters, c)
+	}
+
+	// compile the relabel rules
+	s.relabels = make([]*relabel, 0, len(s.DustDevil.Relabels))
+	for _, r := range s.DustDevil.Relabels {
+		var c *relabel
+		if c, err = compileRelabel(r); err != nil {
+			return err
+		}
+		s.relabels = append(s.relabels, c)
+	}
+
+	// compile the string conversion rules
+	s.conversions = make([]*conversion, 0,
+		len(s.DustDevil.StringConversions))
+	for _, v := range s.DustDevil.StringConversions {
+		var c *conversion
+		if c, err = compileConversion(v); err != nil {
+			return err
+		}
+		s.conversions = append(s.conversions, c)
+	}
+
+	// compile the sampling rules
+	s.samples = make([]*sample, 0, len(s.DustDevil.Samples))
+	for _, v := range s.DustDevil.Samples {
+		var c *sample
+		if c, err = compileSample(v); err != nil {
+			return err
+		}
+		s.samples = append(s.samples, c)
+	}
+
+	// load the transformation script
+	if s.DustDevil.ScriptFile != `` {
+		if s.script, err = loadScript(s.DustDevil.ScriptFile,
+			s.DustDevil.ScriptFunction, time.Duration(
+				s.DustDevil.ScriptTimeout)*time.Millisecond); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Configure sets the settings used by Dispatch
+func Configure(s *Settings) {
+	settings = s
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
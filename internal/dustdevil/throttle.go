@@ -0,0 +1,178 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+	"math/rand"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Throttle limits the number of forwarded metrics per second per
+// host and in total. It is shared by all handlers.
+type Throttle struct {
+	lock      sync.Mutex
+	hostRate  float64
+	hostBurst float64
+	hosts     map[int]*bucket
+	global    *bucket
+}
+
+// bucket is a token bucket that refills at rate tokens per second
+// up to burst tokens
+type bucket struct {
+	tokens float64
+	rate   float64
+	burst  float64
+	last   time.Time
+}
+
+// NewThrottle returns the Throttle configured in s. If no limit is
+// configured, nil is returned.
+func NewThrottle(s *Settings) *Throttle {
+	if s.DustDevil.LimitHostRate == 0 && s.DustDevil.LimitGlobalRate == 0 {
+		return nil
+	}
+
+	t := &Throttle{
+		hostRate:  float64(s.DustDevil.LimitHostRate),
+		hostBurst: float64(s.DustDevil.LimitHostBurst),
+		hosts:     make(map[int]*bucket),
+	}
+	if s.DustDevil.LimitGlobalRate > 0 {
+		t.global = newBucket(float64(s.DustDevil.LimitGlobalRate),
+			float64(s.DustDevil.LimitGlobalBurst))
+	}
+	return t
+}
+
+// allow takes n tokens for hostID from the host's bucket and the
+// global bucket. It returns whether the tokens were available and,
+// if not, whether the global limit was exceeded.
+func (t *Throttle) allow(hostID, n int) (ok, global bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	var host *bucket
+	if t.hostRate > 0 {
+		if host = t.hosts[hostID]; host == nil {
+			host = newBucket(t.hostRate, t.hostBurst)
+			t.hosts[hostID] = host
+		}
+		if !host.take(now, float64(n)) {
+			return false, false
+		}
+	}
+	if t.global != nil && !t.global.take(now, float64(n)) {
+		// return the host's tokens that were not used
+		if host != nil {
+			host.tokens += float64(n)
+		}
+		return false, true
+	}
+	return true, false
+}
+
+// expire removes the buckets of hosts that were idle for maxAge
+func (t *Throttle) expire(maxAge time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	for hostID, b := range t.hosts {
+		if now.Sub(b.last) > maxAge {
+			delete(t.hosts, hostID)
+		}
+	}
+}
+
+// newBucket returns a full bucket. A burst smaller than rate is
+// raised to rate.
+func newBucket(rate, burst float64) *bucket {
+	if burst < rate {
+		burst = rate
+	}
+	return &bucket{
+		tokens: burst,
+		rate:   rate,
+		burst:  burst,
+		last:   time.Now(),
+	}
+}
+
+// take refills b for the time passed until now and removes n tokens
+// if they are available
+func (b *bucket) take(now time.Time, n float64) bool {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Sample is a sampling rule. Metrics whose path matches the glob are
+// forwarded with the configured probability.
+type Sample struct {
+	// shell glob matched against the metric path
+	PathGlob string `json:"path.glob"`
+	// probability between 0 and 1 that a metric is forwarded
+	Rate string `json:"rate"`
+}
+
+// sample is the compiled form of a Sample
+type sample struct {
+	glob string
+	rate float64
+}
+
+// compileSample returns the compiled form of s
+func compileSample(s Sample) (*sample, error) {
+	var err error
+
+	if s.PathGlob == `` {
+		return nil, fmt.Errorf("Sample without path.glob")
+	}
+	if _, err = path.Match(s.PathGlob, ``); err != nil {
+		return nil, fmt.Errorf("Sample %s: %s", s.PathGlob, err)
+	}
+
+	c := &sample{glob: s.PathGlob}
+	if c.rate, err = strconv.ParseFloat(s.Rate, 64); err != nil {
+		return nil, fmt.Errorf("Sample %s: %s", s.PathGlob, err)
+	}
+	if c.rate < 0 || c.rate > 1 {
+		return nil, fmt.Errorf("Sample %s: rate %s not between 0"+
+			" and 1", s.PathGlob, s.Rate)
+	}
+	return c, nil
+}
+
+// sampled returns false if the metric metricPath is discarded by the
+// first matching sampling rule
+func (s *Settings) sampled(metricPath string) bool {
+	for _, c := range s.samples {
+		if ok, _ := path.Match(c.glob, metricPath); ok {
+			return rand.Float64() < c.rate
+		}
+	}
+	return true
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,241 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/legacy"
+)
+
+// testSettings returns the settings with the JSON encoded members
+// options of the dustdevil section
+func testSettings(t *testing.T, options string) *Settings {
+	t.Helper()
+	s := &Settings{}
+	if err := s.fromJSON([]byte(`{"dustdevil":{` + options +
+		`}}`)); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBucketTake(t *testing.T) {
+	start := time.Now()
+	b := newBucket(10, 20)
+	b.last = start
+
+	tests := []struct {
+		after time.Duration
+		n     float64
+		ok    bool
+		left  float64
+	}{
+		{after: 0, n: 15, ok: true, left: 5},
+		{after: 0, n: 6, ok: false, left: 5},
+		{after: 100 * time.Millisecond, n: 6, ok: true, left: 0},
+		{after: time.Hour, n: 0, ok: true, left: 20},
+		{after: time.Hour, n: 21, ok: false, left: 20},
+		// time running backwards refills nothing
+		{after: time.Minute, n: 20, ok: true, left: 0},
+	}
+
+	for i, tc := range tests {
+		ok := b.take(start.Add(tc.after), tc.n)
+		if ok != tc.ok || b.tokens != tc.left {
+			t.Errorf("Step %d: take(%f) = %t with %f left,"+
+				" expected %t with %f", i, tc.n, ok, b.tokens, tc.ok,
+				tc.left)
+		}
+	}
+
+	if b := newBucket(10, 5); b.burst != 10 || b.tokens != 10 {
+		t.Errorf("Burst below rate: burst %f, tokens %f", b.burst,
+			b.tokens)
+	}
+}
+
+func TestThrottleAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		// host IDs and metric counts of consecutive requests
+		hosts  []int
+		counts []int
+		ok     []bool
+		global []bool
+	}{
+		{name: `host limit`,
+			options: `"limit.host.metrics.per.second":"2"`,
+			hosts:   []int{1, 1, 1, 2},
+			counts:  []int{1, 1, 1, 2},
+			ok:      []bool{true, true, false, true},
+			global:  []bool{false, false, false, false}},
+		{name: `host burst`,
+			options: `"limit.host.metrics.per.second":"2",` +
+				`"limit.host.burst":"5"`,
+			hosts:  []int{1, 1, 1},
+			counts: []int{4, 1, 1},
+			ok:     []bool{true, true, false},
+			global: []bool{false, false, false}},
+		{name: `global limit`,
+			options: `"limit.global.metrics.per.second":"3"`,
+			hosts:   []int{1, 2, 3},
+			counts:  []int{2, 1, 1},
+			ok:      []bool{true, true, false},
+			global:  []bool{false, false, true}},
+		{name: `global rejection returns host tokens`,
+			options: `"limit.host.metrics.per.second":"2",` +
+				`"limit.global.metrics.per.second":"2"`,
+			hosts:  []int{1, 2, 2},
+			counts: []int{1, 2, 1},
+			ok:     []bool{true, false, true},
+			global: []bool{false, true, false}},
+	}
+
+	for _, tc := range tests {
+		th := NewThrottle(testSettings(t, tc.options))
+		for i := range tc.hosts {
+			ok, global := th.allow(tc.hosts[i], tc.counts[i])
+			if ok != tc.ok[i] || global != tc.global[i] {
+				t.Errorf("%s: request %d = %t, %t; expected %t, %t",
+					tc.name, i, ok, global, tc.ok[i], tc.global[i])
+			}
+		}
+	}
+
+	if th := NewThrottle(testSettings(t, ``)); th != nil {
+		t.Error(`Throttle without limits`)
+	}
+}
+
+func TestThrottleExpire(t *testing.T) {
+	th := NewThrottle(testSettings(t,
+		`"limit.host.metrics.per.second":"2"`))
+	th.allow(1, 1)
+	th.allow(2, 1)
+	th.hosts[1].last = time.Now().Add(-time.Hour)
+
+	th.expire(time.Minute)
+	if _, ok := th.hosts[1]; ok {
+		t.Error(`Idle host was not expired`)
+	}
+	if _, ok := th.hosts[2]; !ok {
+		t.Error(`Active host was expired`)
+	}
+}
+
+func TestCompileSample(t *testing.T) {
+	tests := []struct {
+		rule  Sample
+		valid bool
+	}{
+		{Sample{PathGlob: `/*`, Rate: `0`}, true},
+		{Sample{PathGlob: `/*`, Rate: `0.25`}, true},
+		{Sample{PathGlob: `/*`, Rate: `1`}, true},
+		{Sample{Rate: `0.5`}, false},
+		{Sample{PathGlob: `[`, Rate: `0.5`}, false},
+		{Sample{PathGlob: `/*`, Rate: `half`}, false},
+		{Sample{PathGlob: `/*`, Rate: `-0.1`}, false},
+		{Sample{PathGlob: `/*`, Rate: `1.1`}, false},
+	}
+
+	for _, tc := range tests {
+		if _, err := compileSample(tc.rule); (err == nil) != tc.valid {
+			t.Errorf("%+v: valid=%t, error: %v", tc.rule, tc.valid,
+				err)
+		}
+	}
+}
+
+func TestSampled(t *testing.T) {
+	s := testSettings(t, `"sampling":[
+		{"path.glob":"/debug/keep","rate":"1"},
+		{"path.glob":"/debug/*","rate":"0"}
+	]`)
+
+	tests := []struct {
+		path    string
+		sampled bool
+	}{
+		{path: `/debug/keep`, sampled: true},
+		{path: `/debug/trace`, sampled: false},
+		{path: `/sys/load`, sampled: true},
+	}
+
+	for _, tc := range tests {
+		for i := 0; i < 10; i++ {
+			if s.sampled(tc.path) != tc.sampled {
+				t.Errorf("%s: sampled=%t, expected %t", tc.path,
+					!tc.sampled, tc.sampled)
+				break
+			}
+		}
+	}
+}
+
+func TestThrottleBatchAndSplit(t *testing.T) {
+	d := newTestHandler(t, `batch`, false, ``,
+		`"limit.host.metrics.per.second":"3",`+
+			`"sampling":[{"path.glob":"/debug/*","rate":"0"}]`)
+	d.Throttle = NewThrottle(d.Settings)
+
+	batch := &legacy.MetricBatch{
+		HostID: 1,
+		Data: []legacy.MetricData{{
+			FloatMetrics: []legacy.FloatMetric{
+				{Metric: `/sys/load`},
+				{Metric: `/debug/latency`},
+			},
+			IntMetrics: []legacy.IntMetric{
+				{Metric: `/sys/processes`},
+				{Metric: `/sys/threads`},
+			},
+			StringMetrics: []legacy.StringMetric{
+				{Metric: `/sys/os`},
+			},
+		}},
+	}
+	msg := &erebos.Transport{HostID: 1}
+	if err := d.throttleBatch(batch, msg); err != nil {
+		t.Fatal(err)
+	}
+	data := batch.Data[0]
+	if len(data.FloatMetrics) != 1 || len(data.IntMetrics) != 2 ||
+		len(data.StringMetrics) != 0 {
+		t.Errorf("Throttled batch %+v", data)
+	}
+
+	tests := []struct {
+		hostID int
+		path   string
+		tags   int
+		keep   bool
+	}{
+		{hostID: 1, path: `/sys/load`, tags: 1, keep: false},
+		{hostID: 2, path: `/debug/latency`, tags: 1, keep: false},
+		{hostID: 2, path: `/sys/load`, tags: 2, keep: true},
+		{hostID: 2, path: `/sys/load`, tags: 2, keep: false},
+	}
+
+	for _, tc := range tests {
+		split := &legacy.MetricSplit{HostID: tc.hostID, Path: tc.path,
+			Tags: make([]string, tc.tags)}
+		keep, err := d.throttleSplit(split,
+			&erebos.Transport{HostID: tc.hostID})
+		if err != nil || keep != tc.keep {
+			t.Errorf("%d %s %d tags: keep=%t (%v), expected %t",
+				tc.hostID, tc.path, tc.tags, keep, err, tc.keep)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,42 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"time"
+)
+
+// timeWindow checks ts against the acceptance window around the
+// reference time ref. It returns ts clamped into the window and
+// whether ts was inside the window.
+func (s *Settings) timeWindow(ts, ref time.Time) (time.Time, bool) {
+	if s.DustDevil.TimestampMaxFuture > 0 {
+		limit := ref.Add(time.Duration(
+			s.DustDevil.TimestampMaxFuture) * time.Second)
+		if ts.After(limit) {
+			return limit, false
+		}
+	}
+	if s.DustDevil.TimestampMaxPast > 0 {
+		limit := ref.Add(-time.Duration(
+			s.DustDevil.TimestampMaxPast) * time.Second)
+		if ts.Before(limit) {
+			return limit, false
+		}
+	}
+	return ts, true
+}
+
+// checksTime returns true if any timestamp check is configured
+func (s *Settings) checksTime() bool {
+	return s.DustDevil.TimestampMaxFuture > 0 ||
+		s.DustDevil.TimestampMaxPast > 0
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
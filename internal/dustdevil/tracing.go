@@ -0,0 +1,138 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/mjolnir42/erebos"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of DustDevil. Without configured exporter
+// the global tracer provider is a no-op.
+var tracer = otel.Tracer(`github.com/solnx/dustdevil`)
+
+// tracingEnabled is set if an exporter is configured, otherwise no
+// lifecycle spans are started
+var tracingEnabled bool
+
+// traces holds the lifecycle spans of in-flight messages by
+// *erebos.Transport, since the transport can not carry a context
+var traces sync.Map
+
+// msgTrace is the lifecycle span of a message and the span of the
+// message waiting in the handler queue
+type msgTrace struct {
+	ctx   context.Context
+	span  trace.Span
+	queue trace.Span
+}
+
+// NewTracing sets up the OTLP trace exporter configured in s and
+// returns the function that flushes and stops it. Without configured
+// endpoint tracing stays a no-op.
+func NewTracing(s *Settings) (func(context.Context) error, error) {
+	// W3C traceparent headers are sent to the HTTP endpoints
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if s.DustDevil.TracingEndpoint == `` {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(s.DustDevil.TracingEndpoint),
+	}
+	if s.DustDevil.TracingInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	ratio, err := strconv.ParseFloat(s.DustDevil.TracingSampleRatio, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(`dustdevil`),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	tracingEnabled = true
+	return provider.Shutdown, nil
+}
+
+// startTrace starts the lifecycle span of msg when it is dispatched.
+// erebos.Transport does not carry the Kafka message headers, trace
+// context set by producers can not be continued.
+func startTrace(msg *erebos.Transport) {
+	if !tracingEnabled {
+		return
+	}
+	ctx, span := tracer.Start(context.Background(), `message`,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.Int(`hostID`, msg.HostID),
+			attribute.String(`topic`, msg.Topic),
+			attribute.Int(`partition`, int(msg.Partition)),
+			attribute.Int64(`offset`, msg.Offset),
+		))
+	_, queue := tracer.Start(ctx, `queue`)
+	traces.Store(msg, &msgTrace{ctx: ctx, span: span, queue: queue})
+}
+
+// dequeued ends the queue span of msg when it is read by a handler
+func dequeued(msg *erebos.Transport) {
+	if t, ok := traces.Load(msg); ok {
+		t.(*msgTrace).queue.End()
+	}
+}
+
+// traceEvent adds the named event to the lifecycle span of msg
+func traceEvent(msg *erebos.Transport, name string) {
+	if t, ok := traces.Load(msg); ok {
+		t.(*msgTrace).span.AddEvent(name)
+	}
+}
+
+// traceContext returns the context of the lifecycle span of msg
+func traceContext(msg *erebos.Transport) context.Context {
+	if msg != nil {
+		if t, ok := traces.Load(msg); ok {
+			return t.(*msgTrace).ctx
+		}
+	}
+	return context.Background()
+}
+
+// endTrace ends the lifecycle span of msg when it is committed
+func endTrace(msg *erebos.Transport) {
+	if t, ok := traces.LoadAndDelete(msg); ok {
+		t.(*msgTrace).span.AddEvent(`commit`)
+		t.(*msgTrace).span.End()
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
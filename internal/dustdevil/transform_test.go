@@ -0,0 +1,168 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/legacy"
+)
+
+// TestPipelineOrder checks that all input formats run the steps of
+// the processing pipeline in the same order
+func TestPipelineOrder(t *testing.T) {
+	ts := time.Now().UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name    string
+		options string
+		strip   bool
+		metrics []legacy.MetricSplit
+		// the only metric path expected to be forwarded
+		sent string
+		// expected host statistics
+		forwarded int64
+		dropped   int64
+		stripped  int64
+	}{
+		{name: `convert before strip`,
+			options: `"string.conversions":[{"name":"state",` +
+				`"path.glob":"/sys/state","values":{"up":"1"}}]`,
+			strip: true,
+			metrics: []legacy.MetricSplit{
+				{Path: `/sys/state`, Type: `string`,
+					Val: legacy.MetricValue{StrVal: `up`}},
+				{Path: `/sys/os`, Type: `string`,
+					Val: legacy.MetricValue{StrVal: `linux`}},
+			},
+			sent: `/sys/state`, forwarded: 1, stripped: 1},
+		{name: `filter before relabel`,
+			options: `"filters":[{"name":"load",` +
+				`"path.glob":"/sys/load","action":"exclude"}],` +
+				`"relabel":[{"source":"path","target":"path",` +
+				`"regex":"/sys/other","replacement":"/sys/load"}]`,
+			metrics: []legacy.MetricSplit{
+				{Path: `/sys/other`, Type: `real`},
+				{Path: `/sys/load`, Type: `real`},
+			},
+			sent: `/sys/load`, forwarded: 1, dropped: 1},
+		{name: `drop unconfigured before throttle`,
+			options: `"enrich.drop.unconfigured":"true",` +
+				`"limit.host.metrics.per.second":"1",` +
+				`"limit.host.burst":"1"`,
+			metrics: []legacy.MetricSplit{
+				{Path: `/sys/other`, Type: `real`},
+				{Path: `/sys/load`, Type: `real`},
+			},
+			sent: `/sys/load`, forwarded: 1, dropped: 1},
+		{name: `filter before throttle`,
+			options: `"filters":[{"name":"other",` +
+				`"path.glob":"/sys/other","action":"exclude"}],` +
+				`"limit.host.metrics.per.second":"1",` +
+				`"limit.host.burst":"1"`,
+			metrics: []legacy.MetricSplit{
+				{Path: `/sys/other`, Type: `real`},
+				{Path: `/sys/load`, Type: `real`},
+			},
+			sent: `/sys/load`, forwarded: 1, dropped: 1},
+	}
+
+	for _, format := range []string{`batch`, `batch/elastic`, `split`} {
+		for _, tc := range tests {
+			t.Run(format+`/`+tc.name, func(t *testing.T) {
+				sink := newTestSink(t, http.StatusOK)
+				d := newTestHandler(t, format[:5],
+					format == `batch/elastic`, sink.URL, tc.options)
+				d.Config.DustDevil.StripStringMetrics = tc.strip
+				d.Throttle = NewThrottle(d.Settings)
+				d.thresholds = configured(9, map[string]string{
+					`/sys/load`: `load`,
+				})
+
+				msgs := pipelineMessages(t, format[:5], ts, tc.metrics)
+				for _, msg := range msgs {
+					d.process(msg)
+				}
+				if format == `split` {
+					d.assemblyLock.Lock()
+					d.release()
+					d.assemblyLock.Unlock()
+				}
+				d.delay.Wait()
+				noDeath(t, d)
+
+				body := bytes.Join(sink.posts(), nil)
+				for _, m := range tc.metrics {
+					sent := bytes.Contains(body,
+						[]byte(`"`+m.Path+`"`))
+					if sent != (m.Path == tc.sent) {
+						t.Errorf("Metric %s forwarded=%t, expected"+
+							" %t", m.Path, sent, m.Path == tc.sent)
+					}
+				}
+				st, _ := d.Stats.Lookup(9)
+				if st.Forwarded != tc.forwarded ||
+					st.Dropped != tc.dropped ||
+					st.Stripped != tc.stripped {
+					t.Errorf("Forwarded/dropped/stripped %d/%d/%d,"+
+						" expected %d/%d/%d", st.Forwarded, st.Dropped,
+						st.Stripped, tc.forwarded, tc.dropped,
+						tc.stripped)
+				}
+				if n := committed(msgs...); n != len(msgs) {
+					t.Errorf("Committed %d of %d messages", n,
+						len(msgs))
+				}
+			})
+		}
+	}
+}
+
+// pipelineMessages returns the metrics of host 9 at ts as messages in
+// format
+func pipelineMessages(t *testing.T, format string, ts time.Time, splits []legacy.MetricSplit) []*erebos.Transport {
+	t.Helper()
+	msgs := []*erebos.Transport{}
+	data := legacy.MetricData{
+		Time:          ts,
+		FloatMetrics:  []legacy.FloatMetric{},
+		IntMetrics:    []legacy.IntMetric{},
+		StringMetrics: []legacy.StringMetric{},
+	}
+	for i, split := range splits {
+		split.HostID = 9
+		split.TS = ts
+		switch split.Type {
+		case `real`:
+			data.FloatMetrics = append(data.FloatMetrics,
+				legacy.FloatMetric{Metric: split.Path,
+					Value: split.Val.FlpVal})
+		case `string`:
+			data.StringMetrics = append(data.StringMetrics,
+				legacy.StringMetric{Metric: split.Path,
+					Value: split.Val.StrVal})
+		}
+		if format == `split` {
+			msgs = append(msgs, testMessage(t, 9, int64(i+1), &split))
+		}
+	}
+	if format == `batch` {
+		msgs = append(msgs, testMessage(t, 9, 1, &legacy.MetricBatch{
+			HostID: 9,
+			Data:   []legacy.MetricData{data},
+		}))
+	}
+	return msgs
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,123 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package dustdevil // import "github.com/solnx/dustdevil/internal/dustdevil"
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Watchdog detects handlers that stopped processing heartbeats or
+// queued messages
+type Watchdog struct {
+	// Stalled receives the number of a stalled handler if restarts
+	// are enabled
+	Stalled   chan int
+	Shutdown  chan struct{}
+	health    *Health
+	registry  metrics.Registry
+	threshold time.Duration
+	restart   bool
+	stalled   map[int]bool
+}
+
+// NewWatchdog returns the Watchdog configured in s, observing the
+// handler activity recorded in h. If the watchdog is disabled, nil
+// is returned.
+func NewWatchdog(s *Settings, h *Health, registry metrics.Registry) *Watchdog {
+	if s.DustDevil.WatchdogStall == 0 {
+		return nil
+	}
+	return &Watchdog{
+		Stalled:  make(chan int, 1),
+		Shutdown: make(chan struct{}),
+		health:   h,
+		registry: registry,
+		threshold: time.Duration(s.DustDevil.WatchdogStall) *
+			time.Second,
+		restart: s.DustDevil.WatchdogRestart,
+		stalled: make(map[int]bool),
+	}
+}
+
+// Run checks the handlers until Shutdown is closed
+func (w *Watchdog) Run() {
+	ticker := time.NewTicker(w.threshold / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.Shutdown:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check evaluates all handlers. A handler is stalled if it did not
+// process a heartbeat, or did not process a message while its queue
+// is not empty, for longer than the threshold.
+func (w *Watchdog) check() {
+	now := time.Now()
+	for _, d := range selectHandlers(``) {
+		beat, processed := w.health.activity(d.Num)
+
+		reason := ``
+		switch {
+		case now.Sub(beat) > w.threshold:
+			reason = fmt.Sprintf("no heartbeat for %s",
+				now.Sub(beat))
+		case len(d.Input) > 0 && now.Sub(processed) > w.threshold:
+			reason = fmt.Sprintf("no message processed for %s"+
+				" with %d queued", now.Sub(processed), len(d.Input))
+		}
+
+		gauge := metrics.GetOrRegisterGauge(
+			fmt.Sprintf("/watchdog/handler/%d/stalled", d.Num),
+			w.registry)
+		if reason == `` {
+			gauge.Update(0)
+			w.stalled[d.Num] = false
+			continue
+		}
+		gauge.Update(1)
+		if w.stalled[d.Num] {
+			// already reported
+			continue
+		}
+		w.stalled[d.Num] = true
+		w.report(d.Num, reason)
+	}
+}
+
+// report logs the stalled handler num with a dump of all goroutines
+// and triggers a restart if enabled
+func (w *Watchdog) report(num int, reason string) {
+	metrics.GetOrRegisterCounter(`/watchdog/stalls`,
+		w.registry).Inc(1)
+
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	logrus.WithField(`handler`, num).Errorf(
+		"Handler %d stalled: %s\n%s", num, reason, buf)
+
+	if w.restart {
+		select {
+		case w.Stalled <- num:
+		default:
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix